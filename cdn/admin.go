@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// adminServer exposes cache management endpoints. It runs on its own listener
+// so it is never reachable through the public edge port.
+type adminServer struct {
+	edge  *EdgeServer
+	token string
+}
+
+func newAdminHandler(es *EdgeServer, token string) http.Handler {
+	a := &adminServer{edge: es, token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /purge/url", a.handlePurgeURL)
+	mux.HandleFunc("POST /purge/prefix", a.handlePurgePrefix)
+	mux.HandleFunc("POST /purge/tag", a.handlePurgeTag)
+	mux.HandleFunc("POST /purge/all", a.handlePurgeAll)
+	mux.HandleFunc("GET /stats/disk", a.handleDiskStats)
+	return a.authenticate(mux)
+}
+
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *adminServer) handlePurgeURL(w http.ResponseWriter, r *http.Request) {
+	target := r.FormValue("url")
+	if target == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	soft, ok := softParam(w, r)
+	if !ok {
+		return
+	}
+	res, err := a.edge.PurgeURL(target, soft)
+	if err != nil {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	log.Printf("admin: %s url %q (%d entries)", purgeVerb(soft), target, res.Purged)
+	writeJSON(w, res)
+}
+
+func (a *adminServer) handlePurgePrefix(w http.ResponseWriter, r *http.Request) {
+	prefix := r.FormValue("prefix")
+	if prefix == "" {
+		http.Error(w, "prefix is required", http.StatusBadRequest)
+		return
+	}
+	soft, ok := softParam(w, r)
+	if !ok {
+		return
+	}
+	res, err := a.edge.PurgePrefix(prefix, soft)
+	if err != nil {
+		http.Error(w, "invalid prefix", http.StatusBadRequest)
+		return
+	}
+	log.Printf("admin: %s prefix %q (%d entries)", purgeVerb(soft), prefix, res.Purged)
+	writeJSON(w, res)
+}
+
+func (a *adminServer) handlePurgeTag(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimSpace(r.FormValue("tag"))
+	if tag == "" {
+		http.Error(w, "tag is required", http.StatusBadRequest)
+		return
+	}
+	soft, ok := softParam(w, r)
+	if !ok {
+		return
+	}
+	res := a.edge.PurgeTag(tag, soft)
+	log.Printf("admin: %s tag %q (%d entries)", purgeVerb(soft), tag, res.Purged)
+	writeJSON(w, res)
+}
+
+func (a *adminServer) handlePurgeAll(w http.ResponseWriter, r *http.Request) {
+	soft, ok := softParam(w, r)
+	if !ok {
+		return
+	}
+	res := a.edge.PurgeAll(soft)
+	log.Printf("admin: %s everything (%d entries)", purgeVerb(soft), res.Purged)
+	writeJSON(w, res)
+}
+
+func (a *adminServer) handleDiskStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.edge.disk.Stats())
+}
+
+// softParam reads the optional soft=true|false purge flag, answering 400 on
+// anything else.
+func softParam(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	raw := r.FormValue("soft")
+	if raw == "" {
+		return false, true
+	}
+	soft, err := strconv.ParseBool(raw)
+	if err != nil {
+		http.Error(w, "soft must be true or false", http.StatusBadRequest)
+		return false, false
+	}
+	return soft, true
+}
+
+func purgeVerb(soft bool) string {
+	if soft {
+		return "soft-purged"
+	}
+	return "purged"
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,150 @@
+package main
+
+import "container/list"
+
+// arcEvictor is Adaptive Replacement Cache (Megiddo & Modha, FAST '03)
+// adapted to a byte budget. t1 holds keys seen once recently, t2 keys seen at
+// least twice; b1 and b2 remember keys recently evicted from each. A ghost hit
+// in b1 grows the target share p of t1, a ghost hit in b2 shrinks it. All
+// sizes, including p, are in bytes, and the ghosts together are kept no
+// larger than the resident set.
+type arcEvictor struct {
+	t1, t2, b1, b2 *list.List // of *arcNode, most recent first
+	nodes          map[string]*arcNode
+	ghosts         map[string]*arcNode
+	t1Bytes        int64
+	t2Bytes        int64
+	b1Bytes        int64
+	b2Bytes        int64
+	p              int64
+}
+
+type arcNode struct {
+	key  string
+	size int64
+	list *list.List
+	elem *list.Element
+}
+
+func newARCEvictor() *arcEvictor {
+	return &arcEvictor{
+		t1:     list.New(),
+		t2:     list.New(),
+		b1:     list.New(),
+		b2:     list.New(),
+		nodes:  make(map[string]*arcNode),
+		ghosts: make(map[string]*arcNode),
+	}
+}
+
+func (e *arcEvictor) add(key string, size int64) {
+	if node, ok := e.nodes[key]; ok {
+		e.unlink(node)
+		node.size = size
+		e.push(node, e.t2)
+		return
+	}
+
+	node := &arcNode{key: key, size: size}
+	if ghost, ok := e.ghosts[key]; ok {
+		resident := e.t1Bytes + e.t2Bytes
+		if ghost.list == e.b1 {
+			e.p = min(e.p+arcDelta(size, e.b1Bytes, e.b2Bytes, resident), resident)
+		} else {
+			e.p = max(e.p-arcDelta(size, e.b2Bytes, e.b1Bytes, resident), 0)
+		}
+		e.unlink(ghost)
+		delete(e.ghosts, key)
+		e.push(node, e.t2)
+	} else {
+		e.push(node, e.t1)
+	}
+	e.nodes[key] = node
+}
+
+// arcDelta is ARC's adaptation step, max(1, |other|/|own|), scaled by the
+// size of the object that caused it and capped at limit.
+func arcDelta(size, own, other, limit int64) int64 {
+	ratio := 1.0
+	if own > 0 && other > own {
+		ratio = float64(other) / float64(own)
+	}
+	d := float64(size) * ratio
+	if d > float64(limit) {
+		return limit
+	}
+	return int64(d)
+}
+
+func (e *arcEvictor) access(key string) {
+	if node, ok := e.nodes[key]; ok {
+		e.unlink(node)
+		e.push(node, e.t2)
+	}
+}
+
+func (e *arcEvictor) remove(key string) {
+	if node, ok := e.nodes[key]; ok {
+		e.unlink(node)
+		delete(e.nodes, key)
+	}
+}
+
+func (e *arcEvictor) victim() (string, bool) {
+	var from, ghost *list.List
+	switch {
+	case e.t1.Len() > 0 && (e.t1Bytes > e.p || e.t2.Len() == 0):
+		from, ghost = e.t1, e.b1
+	case e.t2.Len() > 0:
+		from, ghost = e.t2, e.b2
+	default:
+		return "", false
+	}
+
+	node := from.Back().Value.(*arcNode)
+	e.unlink(node)
+	delete(e.nodes, node.key)
+	e.push(node, ghost)
+	e.ghosts[node.key] = node
+	e.trimGhosts()
+	return node.key, true
+}
+
+// trimGhosts drops the oldest ghosts until they fit in the resident size,
+// taking from whichever ghost list is over its share of the budget.
+func (e *arcEvictor) trimGhosts() {
+	resident := e.t1Bytes + e.t2Bytes
+	for e.b1Bytes+e.b2Bytes > resident {
+		from := e.b2
+		if e.b1.Len() > 0 && (e.b1Bytes > resident-e.p || e.b2.Len() == 0) {
+			from = e.b1
+		}
+		oldest := from.Back().Value.(*arcNode)
+		e.unlink(oldest)
+		delete(e.ghosts, oldest.key)
+	}
+}
+
+func (e *arcEvictor) push(node *arcNode, l *list.List) {
+	node.list = l
+	node.elem = l.PushFront(node)
+	*e.bytesOf(l) += node.size
+}
+
+func (e *arcEvictor) unlink(node *arcNode) {
+	node.list.Remove(node.elem)
+	*e.bytesOf(node.list) -= node.size
+}
+
+func (e *arcEvictor) bytesOf(l *list.List) *int64 {
+	switch l {
+	case e.t1:
+		return &e.t1Bytes
+	case e.t2:
+		return &e.t2Bytes
+	case e.b1:
+		return &e.b1Bytes
+	default:
+		return &e.b2Bytes
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// cacheKeyer builds base cache keys according to operator rules. Requests no
+// rule matches, and every request when there are no rules, keep the plain
+// cacheBaseKey form.
+type cacheKeyer struct {
+	rules []keyRule
+}
+
+// keyRule normalizes the keys of requests whose host and path match its
+// patterns. Patterns are exact, or prefixes when they end in "*"; a host
+// pattern may also start with "*." to cover subdomains.
+type keyRule struct {
+	hostPattern string
+	pathPattern string
+
+	// query is "keep", "sort" or "ignore". allow, when set, is the only
+	// parameters kept; deny parameters are dropped. Both take patterns.
+	query string
+	allow []string
+	deny  []string
+	// host is "ignore" (the default: the key has no host, as without
+	// rules), "keep" or "lower".
+	host      string
+	lowerPath bool
+	// headers and cookies named here become part of the key.
+	headers []string
+	cookies []string
+}
+
+// baseKey returns the base cache key of r: its method, normalized URL and any
+// configured header and cookie values.
+func (k *cacheKeyer) baseKey(r *http.Request) string {
+	rule := k.match(r.Host, r.URL.Path)
+	if rule == nil {
+		return cacheBaseKey(r)
+	}
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteString(":")
+	b.WriteString(rule.uri(r.Host, r.URL, true))
+	// The extra parts go after a "|", like Vary parts, so a purge of the
+	// URL still covers every value.
+	for _, h := range rule.headers {
+		b.WriteString("|h:")
+		b.WriteString(h)
+		b.WriteString("=")
+		b.WriteString(strings.TrimSpace(r.Header.Get(h)))
+	}
+	for _, name := range rule.cookies {
+		b.WriteString("|c:")
+		b.WriteString(name)
+		b.WriteString("=")
+		if c, err := r.Cookie(name); err == nil {
+			b.WriteString(c.Value)
+		}
+	}
+	return b.String()
+}
+
+// purgeKey returns what base keys for method and u start with, for purging.
+// Header and cookie parts are left out so every value is matched. For a
+// prefix purge the query is used as given. Rules that key on the host only
+// apply when u is absolute.
+func (k *cacheKeyer) purgeKey(method string, u *url.URL, prefix bool) string {
+	rule := k.match(u.Host, u.Path)
+	if rule == nil {
+		return method + ":" + u.RequestURI()
+	}
+	return method + ":" + rule.uri(u.Host, u, !prefix)
+}
+
+func (k *cacheKeyer) match(host, path string) *keyRule {
+	if k == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for i := range k.rules {
+		if k.rules[i].matches(host, path) {
+			return &k.rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *keyRule) matches(host, path string) bool {
+	switch {
+	case r.hostPattern == "":
+	case strings.HasPrefix(r.hostPattern, "*."):
+		if host != r.hostPattern[2:] && !strings.HasSuffix(host, r.hostPattern[1:]) {
+			return false
+		}
+	case !patternMatch(r.hostPattern, host):
+		return false
+	}
+	return r.pathPattern == "" || patternMatch(r.pathPattern, path)
+}
+
+// uri is the host, path and query part of a key. normalizeQuery is false
+// for purge prefixes, whose query is taken literally.
+func (r *keyRule) uri(host string, u *url.URL, normalizeQuery bool) string {
+	var b strings.Builder
+	switch r.host {
+	case "keep":
+		b.WriteString(host)
+	case "lower":
+		b.WriteString(strings.ToLower(host))
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if r.lowerPath {
+		path = strings.ToLower(path)
+	}
+	b.WriteString(path)
+
+	query := u.RawQuery
+	if normalizeQuery {
+		query = r.normalizeQuery(query)
+	}
+	if query != "" {
+		b.WriteString("?")
+		b.WriteString(query)
+	}
+	return b.String()
+}
+
+// normalizeQuery filters and orders raw query parameters. Values keep their
+// original encoding; only names are decoded for matching and sorting.
+func (r *keyRule) normalizeQuery(raw string) string {
+	if raw == "" || r.query == "ignore" {
+		return ""
+	}
+	if r.query != "sort" && len(r.allow) == 0 && len(r.deny) == 0 {
+		return raw
+	}
+	type param struct{ name, raw string }
+	var params []param
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		rawName, _, _ := strings.Cut(pair, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			name = rawName
+		}
+		if len(r.allow) > 0 && !anyPatternMatch(r.allow, name) {
+			continue
+		}
+		if anyPatternMatch(r.deny, name) {
+			continue
+		}
+		params = append(params, param{name: name, raw: pair})
+	}
+	if r.query == "sort" {
+		sort.SliceStable(params, func(i, j int) bool {
+			if params[i].name != params[j].name {
+				return params[i].name < params[j].name
+			}
+			return params[i].raw < params[j].raw
+		})
+	}
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p.raw
+	}
+	return strings.Join(parts, "&")
+}
+
+// patternMatch matches s exactly, or by prefix when pattern ends in "*".
+func patternMatch(pattern, s string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(s, prefix)
+	}
+	return pattern == s
+}
+
+func anyPatternMatch(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if patternMatch(p, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKeyRules reads EDGE_CACHE_KEY_RULES: rules separated by ";", each a
+// list of space-separated key=value settings, for example
+//
+//	match=img.example.com/* query=ignore host=lower; match=/api/* query=sort deny=utm_*,fbclid cookies=tier
+//
+// match is an optional host followed by a path pattern. Rules are tried in
+// order and the first match wins.
+func parseKeyRules(raw string) ([]keyRule, error) {
+	var rules []keyRule
+	for _, spec := range strings.Split(raw, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		rule := keyRule{query: "keep", host: "ignore"}
+		for _, field := range fields {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("key rule %q: expected key=value, got %q", spec, field)
+			}
+			switch strings.ToLower(name) {
+			case "match":
+				if value == "*" {
+					break
+				}
+				host, path := value, ""
+				if i := strings.Index(value, "/"); i >= 0 {
+					host, path = value[:i], value[i:]
+				}
+				rule.hostPattern, rule.pathPattern = strings.ToLower(host), path
+			case "query":
+				value = strings.ToLower(value)
+				if value != "keep" && value != "sort" && value != "ignore" {
+					return nil, fmt.Errorf("key rule %q: query must be keep, sort or ignore", spec)
+				}
+				rule.query = value
+			case "allow":
+				rule.allow = splitCSV(value)
+			case "deny":
+				rule.deny = splitCSV(value)
+			case "host":
+				value = strings.ToLower(value)
+				if value != "ignore" && value != "keep" && value != "lower" {
+					return nil, fmt.Errorf("key rule %q: host must be ignore, keep or lower", spec)
+				}
+				rule.host = value
+			case "path":
+				switch strings.ToLower(value) {
+				case "keep":
+					rule.lowerPath = false
+				case "lower":
+					rule.lowerPath = true
+				default:
+					return nil, fmt.Errorf("key rule %q: path must be keep or lower", spec)
+				}
+			case "headers":
+				for _, h := range splitCSV(value) {
+					rule.headers = append(rule.headers, http.CanonicalHeaderKey(h))
+				}
+			case "cookies":
+				rule.cookies = splitCSV(value)
+			default:
+				return nil, fmt.Errorf("key rule %q: unknown setting %q", spec, name)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ClientCachePolicy controls how much say clients get over cache use through
+// request Cache-Control.
+type ClientCachePolicy string
+
+const (
+	// ClientCacheHonor follows every request directive.
+	ClientCacheHonor ClientCachePolicy = "honor"
+	// ClientCacheIgnoreReload follows request directives except forced
+	// reloads (no-cache, max-age=0, Pragma: no-cache), so a browser reload
+	// storm on a public site cannot reach origin.
+	ClientCacheIgnoreReload ClientCachePolicy = "ignore-reload"
+	// ClientCacheIgnore disregards request Cache-Control altogether.
+	ClientCacheIgnore ClientCachePolicy = "ignore"
+)
+
+// normalizeClientCachePolicy maps unknown names onto ClientCacheHonor.
+func normalizeClientCachePolicy(policy ClientCachePolicy) ClientCachePolicy {
+	switch ClientCachePolicy(strings.ToLower(strings.TrimSpace(string(policy)))) {
+	case ClientCacheIgnoreReload:
+		return ClientCacheIgnoreReload
+	case ClientCacheIgnore:
+		return ClientCacheIgnore
+	default:
+		return ClientCacheHonor
+	}
+}
+
+// requestDirectives are the RFC 9111 §5.2.1 request directives the edge acts
+// on. A negative duration means the directive was absent.
+type requestDirectives struct {
+	noCache      bool
+	onlyIfCached bool
+	maxAge       time.Duration
+	minFresh     time.Duration
+	// maxStale is how far past expiry a response may be; anyStale is set
+	// for a bare max-stale, which accepts any staleness.
+	maxStale time.Duration
+	anyStale bool
+}
+
+// requestDirectives parses the request's Cache-Control under the configured
+// policy.
+func (es *EdgeServer) requestDirectives(r *http.Request) requestDirectives {
+	d := requestDirectives{maxAge: -1, minFresh: -1, maxStale: -1}
+	if es.clientCache == ClientCacheIgnore {
+		return d
+	}
+	values := r.Header.Values("Cache-Control")
+	flags, maxAges := parseCacheControl(values)
+	d.onlyIfCached = flags["only-if-cached"]
+	if v, ok := maxAges["max-age"]; ok {
+		d.maxAge = time.Duration(v) * time.Second
+	}
+	if v, ok := maxAges["min-fresh"]; ok {
+		d.minFresh = time.Duration(v) * time.Second
+	}
+	if v, ok := maxAges["max-stale"]; ok {
+		d.maxStale = time.Duration(v) * time.Second
+	} else if flags["max-stale"] {
+		d.anyStale = true
+	}
+	// Pragma only counts when there is no Cache-Control (RFC 9111 §5.4).
+	d.noCache = flags["no-cache"] || (len(values) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache"))
+
+	if es.clientCache == ClientCacheIgnoreReload {
+		d.noCache = false
+		if d.maxAge == 0 {
+			d.maxAge = -1
+		}
+	}
+	return d
+}
+
+// acceptsFresh reports whether a fresh entry may be served without
+// revalidation.
+func (d requestDirectives) acceptsFresh(entry *CacheEntry, now time.Time) bool {
+	if d.noCache {
+		return false
+	}
+	if d.maxAge >= 0 && entry.currentAge(now) > d.maxAge {
+		return false
+	}
+	if d.minFresh >= 0 && entry.expiresAt.Sub(now) < d.minFresh {
+		return false
+	}
+	return true
+}
+
+// acceptsStale reports whether the client is willing to take an expired
+// entry without revalidation. Entries that must be revalidated never qualify.
+func (d requestDirectives) acceptsStale(entry *CacheEntry, now time.Time) bool {
+	if d.noCache || d.minFresh >= 0 || entry.mustRevalidate || entry.softPurged {
+		return false
+	}
+	if d.maxAge >= 0 && entry.currentAge(now) > d.maxAge {
+		return false
+	}
+	return d.anyStale || (d.maxStale >= 0 && now.Sub(entry.expiresAt) <= d.maxStale)
+}
+
+// forbidsStale reports whether the client ruled out stale responses, which
+// takes precedence over the origin's stale-while-revalidate.
+func (d requestDirectives) forbidsStale(entry *CacheEntry, now time.Time) bool {
+	return d.noCache || d.minFresh >= 0 || (d.maxAge >= 0 && entry.currentAge(now) > d.maxAge)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sync/singleflight"
+)
+
+// zstdWindow caps the zstd window at what browsers accept (RFC 9659).
+const zstdWindow = 8 << 20
+
+// contentEncoders are the codings the edge can produce itself; registering
+// an encoder here is all it takes to offer one.
+var contentEncoders = map[string]func(w io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"br":   func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+	"zstd": func(w io.Writer) io.WriteCloser {
+		// The options are constant and valid, so NewWriter cannot fail.
+		zw, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindow))
+		return zw
+	},
+}
+
+// defaultCompressibleTypes are the media types compressed unless the
+// operator configures others. Types ending in +json or +xml always qualify.
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"image/svg+xml",
+}
+
+// compressor encodes cached responses for clients that accept it. For those
+// clients origin is asked for the identity representation and that is what
+// the key and the fill use; encoded copies are stored next to it under the
+// same key plus "|ce=<coding>", so each object is compressed once per
+// coding. It is off unless EDGE_COMPRESS_ENCODINGS names a coding.
+type compressor struct {
+	encodings []string // in order of preference
+	types     []string
+	minSize   int64
+	// maxSize bounds the bodies compressed, as encoding one costs CPU and
+	// a buffer the size of the result; 0 means no bound.
+	maxSize int64
+	// encoding makes concurrent requests for an encoded copy that is not
+	// stored yet wait for one compression instead of each running it.
+	encoding singleflight.Group
+}
+
+// newCompressor builds a compressor for the configured codings, skipping
+// any the edge has no encoder for. It returns nil if none is left.
+func newCompressor(encodings, types []string, minSize, maxSize int64) *compressor {
+	c := &compressor{types: types, minSize: minSize, maxSize: maxSize}
+	for _, enc := range encodings {
+		enc = strings.ToLower(enc)
+		if _, ok := contentEncoders[enc]; !ok {
+			log.Printf("compression: no encoder for %q, skipping it", enc)
+			continue
+		}
+		c.encodings = append(c.encodings, enc)
+	}
+	if len(c.encodings) == 0 {
+		return nil
+	}
+	if len(c.types) == 0 {
+		c.types = defaultCompressibleTypes
+	}
+	return c
+}
+
+type acceptEncodingKey struct{}
+
+// prepare remembers the client's Accept-Encoding in r for when the response
+// is written. If the edge can encode for the client, it asks origin for
+// identity instead, so the cache key and the origin request no longer depend
+// on it; any other client's header goes to origin as it is.
+func (c *compressor) prepare(r *http.Request) *http.Request {
+	if c == nil {
+		return r
+	}
+	accept := strings.Join(r.Header.Values("Accept-Encoding"), ",")
+	r = r.WithContext(context.WithValue(r.Context(), acceptEncodingKey{}, accept))
+	if bestEncoding(accept, c.encodings) != "identity" {
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+	return r
+}
+
+// withoutClientEncoding drops the remembered Accept-Encoding from ctx, for
+// requests whose response nobody reads.
+func withoutClientEncoding(ctx context.Context) context.Context {
+	return context.WithValue(ctx, acceptEncodingKey{}, "")
+}
+
+// eligible reports whether a response with this status and header is worth
+// compressing at the edge; size is its body length, or -1 if unknown.
+func (c *compressor) eligible(statusCode int, h http.Header, size int64) bool {
+	if c == nil || statusCode != http.StatusOK {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if flags, _ := parseCacheControl(h.Values("Cache-Control")); flags["no-transform"] {
+		return false
+	}
+	if size >= 0 && (size < c.minSize || c.maxSize > 0 && size > c.maxSize) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	return anyPatternMatch(c.types, mediaType)
+}
+
+// negotiate picks the coding to send r, or "" for identity.
+func (c *compressor) negotiate(r *http.Request) string {
+	if c == nil {
+		return ""
+	}
+	accept, _ := r.Context().Value(acceptEncodingKey{}).(string)
+	if accept == "" {
+		return ""
+	}
+	if enc := bestEncoding(accept, c.encodings); enc != "identity" {
+		return enc
+	}
+	return ""
+}
+
+// encodedHeader turns the header of an identity response into that of its
+// enc-coded form. The ETag gets the coding appended since the bytes differ.
+func encodedHeader(h http.Header, enc string) http.Header {
+	out := h.Clone()
+	out.Set("Content-Encoding", enc)
+	out.Del("Content-Length")
+	if etag := out.Get("ETag"); etag != "" {
+		out.Set("ETag", encodedETag(etag, enc))
+	}
+	addVary(out, "Accept-Encoding")
+	return out
+}
+
+func encodedETag(etag, enc string) string {
+	if strings.HasSuffix(etag, `"`) {
+		return etag[:len(etag)-1] + "-" + enc + `"`
+	}
+	return etag
+}
+
+// addVary adds name to the Vary header unless it is already listed.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, item := range strings.Split(v, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || strings.EqualFold(item, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// encodedEntry returns entry, whose identity body is read from body, encoded
+// with enc: from the tiers if an encoded copy of this version is stored
+// there, otherwise by compressing it and storing the result. Freshness
+// always comes from entry itself. An encoded copy served from disk comes
+// back with its body in the returned file, which the caller closes. If the
+// body cannot be read or encoded, nothing is stored and the error returned.
+func (es *EdgeServer) encodedEntry(key string, entry *CacheEntry, body entryBody, enc string) (*CacheEntry, *diskBody, error) {
+	encKey := key + "|ce=" + enc
+	stored, file, found := es.storedEncoding(encKey, entry, enc)
+	if !found {
+		v, err, _ := es.compress.encoding.Do(encKey, func() (any, error) {
+			// The copy may have been stored since the lookup above. The
+			// waiters share the result, so only memory is looked at again.
+			if stored, found := es.cache.GetStale(encKey); found && sameRepresentation(entry, stored, enc) {
+				return stored, nil
+			}
+			stored, err := encodeEntry(entry, body, enc)
+			if err != nil {
+				return nil, err
+			}
+			es.cache.Set(encKey, stored)
+			es.disk.Set(encKey, stored)
+			return stored, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		stored = v.(*CacheEntry)
+		// A waiter holding another version of the object than the request
+		// that ran the compression encodes its own.
+		if !sameRepresentation(entry, stored, enc) {
+			if stored, err = encodeEntry(entry, body, enc); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	view := entry.derive()
+	view.data = stored.data
+	view.header = stored.header
+	view.eTag = stored.eTag
+	return view, file, nil
+}
+
+// storedEncoding looks up the enc-coded copy of entry under encKey in the
+// tiers, provided it was made from the same version. A copy from disk too
+// large to promote has its body in the returned file.
+func (es *EdgeServer) storedEncoding(encKey string, entry *CacheEntry, enc string) (*CacheEntry, *diskBody, bool) {
+	if stored, found := es.cache.GetStale(encKey); found && sameRepresentation(entry, stored, enc) {
+		return stored, nil, true
+	}
+	stored, file, found := es.disk.OpenStale(encKey)
+	if !found {
+		return nil, nil, false
+	}
+	if !sameRepresentation(entry, stored, enc) {
+		_ = file.Close()
+		return nil, nil, false
+	}
+	stored, file = es.promote(encKey, stored, file)
+	return stored, file, true
+}
+
+// encodeEntry compresses the identity body of entry, read from body, with
+// enc and returns the encoded copy, or an error if the body could not be
+// read or encoded in full.
+func encodeEntry(entry *CacheEntry, body entryBody, enc string) (*CacheEntry, error) {
+	var buf bytes.Buffer
+	zw := contentEncoders[enc](&buf)
+	if _, err := io.Copy(zw, io.NewSectionReader(body, 0, body.Size())); err != nil {
+		_ = zw.Close()
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	stored := entry.derive()
+	stored.data = buf.Bytes()
+	stored.header = encodedHeader(entry.header, enc)
+	stored.header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	stored.eTag = stored.header.Get("ETag")
+	return stored, nil
+}
+
+// sameRepresentation reports whether encoded was made from the same body as
+// identity: by ETag, by Last-Modified, or failing both by when identity was
+// fetched.
+func sameRepresentation(identity, encoded *CacheEntry, enc string) bool {
+	switch {
+	case identity.eTag != "":
+		return encoded.eTag == encodedETag(identity.eTag, enc)
+	case identity.lastModified != "":
+		return encoded.lastModified == identity.lastModified
+	default:
+		return encoded.createdAt.Equal(identity.createdAt)
+	}
+}
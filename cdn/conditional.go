@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientValidators are the request headers a client uses to make its request
+// conditional. They describe the client's copy, not ours, so they are never
+// sent upstream on a cache fill.
+var clientValidators = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+// notModifiedHeaders are the fields RFC 9110 §15.4.5 has a 304 carry over
+// from the 200 it stands in for.
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// notModified evaluates a GET or HEAD request's If-None-Match, or failing
+// that its If-Modified-Since, against a 200 response with the given
+// validators (RFC 9110 §13.2.2). It reports whether a 304 is the answer.
+func notModified(r *http.Request, statusCode int, eTag, lastModified string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if statusCode != http.StatusOK {
+		return false
+	}
+	if inm := r.Header.Values("If-None-Match"); len(inm) > 0 {
+		if eTag == "" {
+			return false
+		}
+		for _, v := range inm {
+			if strings.TrimSpace(v) == "*" {
+				return true
+			}
+			for _, tag := range parseETagList(v) {
+				if weakETagMatch(tag, eTag) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !lm.After(ims)
+}
+
+// writeNotModified answers with 304, keeping only the fields of header that
+// belong on one. Vary is merged into what w already lists, since the edge
+// may have added to it for the representation it would have sent.
+func writeNotModified(w http.ResponseWriter, header http.Header) {
+	out := w.Header()
+	for _, k := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Content-Range"} {
+		out.Del(k)
+	}
+	for _, k := range notModifiedHeaders {
+		v := header.Values(k)
+		switch {
+		case len(v) == 0:
+		case k == "Vary":
+			for _, value := range v {
+				for _, name := range strings.Split(value, ",") {
+					if name = strings.TrimSpace(name); name != "" {
+						addVary(out, name)
+					}
+				}
+			}
+		default:
+			out[k] = append([]string(nil), v...)
+		}
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// ifRangeAllows reports whether a Range request may be answered with a
+// partial response. An If-Range that does not strongly match the current
+// representation turns the request into a plain GET (RFC 9110 §13.1.5).
+func ifRangeAllows(r *http.Request, header http.Header) bool {
+	ifRange := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return strongETagMatch(ifRange, header.Get("ETag"))
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	// A date only validates against a strong Last-Modified: one at least a
+	// second older than the response's Date.
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && lm.Equal(date) && !lm.After(responseDate(header).Add(-time.Second))
+}
+
+// parseETagList splits an If-None-Match value into entity tags. Commas may
+// appear inside a quoted tag, so it scans rather than splitting.
+func parseETagList(v string) []string {
+	var tags []string
+	for {
+		v = strings.TrimLeft(v, " \t,")
+		if v == "" {
+			return tags
+		}
+		start := 0
+		if strings.HasPrefix(v, "W/") {
+			start = 2
+		}
+		if len(v) <= start || v[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(v[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, v[:end])
+		v = v[end:]
+	}
+}
+
+// weakETagMatch compares two entity tags ignoring weakness.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(strings.TrimSpace(a), "W/") == strings.TrimPrefix(strings.TrimSpace(b), "W/")
+}
+
+// strongETagMatch compares two entity tags that must both be strong.
+func strongETagMatch(a, b string) bool {
+	a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+	if a == "" || strings.HasPrefix(a, "W/") || strings.HasPrefix(b, "W/") {
+		return false
+	}
+	return a == b
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -10,48 +11,110 @@ import (
 )
 
 type EdgeConfig struct {
-	ListenAddr         string
-	OriginURL          string
-	Origins            []string
-	ShieldURL          string
-	HashReplicas       int
-	MaxMemoryBytes     int64
-	DiskCacheDir       string
-	DiskCacheMaxBytes  int64
-	ClientTimeout      time.Duration
-	InsecureUpstreamTL bool
-	TLSCertFile        string
-	TLSKeyFile         string
+	ListenAddr           string
+	OriginURL            string
+	Origins              []string
+	ShieldURL            string
+	HashReplicas         int
+	MaxMemoryBytes       int64
+	MaxMemoryObjectBytes int64
+	CacheShards          int
+	DiskCacheDir         string
+	DiskCacheMaxBytes    int64
+	ClientTimeout        time.Duration
+	AlwaysOnline         time.Duration
+	HeuristicPercent     int64
+	HeuristicMax         time.Duration
+	TTLRules             string
+	ValidationWindow     time.Duration
+	ExposeSurrogateKeys  bool
+	ClientCacheControl   string
+	CacheKeyRules        string
+	VaryEncodings        []string
+	VaryLanguages        []string
+	MaxVariants          int
+	CompressEncodings    []string
+	CompressTypes        []string
+	CompressMinBytes     int64
+	CompressMaxBytes     int64
+	MaxRanges            int
+	SliceBytes           int64
+	DiskPromoteMaxBytes  int64
+	SharedBodyMaxBytes   int64
+	DiskWriters          int
+	DiskWriteQueue       int
+	DiskEvictHighPercent int
+	DiskEvictLowPercent  int
+	DiskTagPriority      string
+	DiskAccessFlush      time.Duration
+	InsecureUpstreamTL   bool
+	TLSCertFile          string
+	TLSKeyFile           string
+	AdminListenAddr      string
+	AdminToken           string
 }
 
 func loadEdgeConfigFromEnv() EdgeConfig {
 	return EdgeConfig{
-		ListenAddr:         getEnv("EDGE_LISTEN_ADDR", ":8080"),
-		OriginURL:          getEnv("ORIGIN_URL", "http://localhost:8081"),
-		Origins:            splitCSV(os.Getenv("ORIGINS")),
-		ShieldURL:          strings.TrimSpace(os.Getenv("SHIELD_URL")),
-		HashReplicas:       getEnvInt("HASH_REPLICAS", 100),
-		MaxMemoryBytes:     getEnvInt64("EDGE_MAX_MEMORY_BYTES", 128*1024*1024),
-		DiskCacheDir:       strings.TrimSpace(os.Getenv("EDGE_DISK_CACHE_DIR")),
-		DiskCacheMaxBytes:  getEnvInt64("EDGE_DISK_CACHE_MAX_BYTES", 2*1024*1024*1024),
-		ClientTimeout:      time.Duration(getEnvInt("UPSTREAM_TIMEOUT_SEC", 10)) * time.Second,
-		InsecureUpstreamTL: getEnvBool("UPSTREAM_INSECURE_TLS", false),
-		TLSCertFile:        strings.TrimSpace(os.Getenv("EDGE_TLS_CERT_FILE")),
-		TLSKeyFile:         strings.TrimSpace(os.Getenv("EDGE_TLS_KEY_FILE")),
+		ListenAddr:           getEnv("EDGE_LISTEN_ADDR", ":8080"),
+		OriginURL:            getEnv("ORIGIN_URL", "http://localhost:8081"),
+		Origins:              splitCSV(os.Getenv("ORIGINS")),
+		ShieldURL:            strings.TrimSpace(os.Getenv("SHIELD_URL")),
+		HashReplicas:         getEnvInt("HASH_REPLICAS", 100),
+		MaxMemoryBytes:       getEnvInt64("EDGE_MAX_MEMORY_BYTES", 128*1024*1024),
+		MaxMemoryObjectBytes: getEnvInt64("EDGE_MAX_MEMORY_OBJECT_BYTES", 1024*1024),
+		CacheShards:          getEnvInt("EDGE_CACHE_SHARDS", defaultCacheShards),
+		DiskCacheDir:         strings.TrimSpace(os.Getenv("EDGE_DISK_CACHE_DIR")),
+		DiskCacheMaxBytes:    getEnvInt64("EDGE_DISK_CACHE_MAX_BYTES", 2*1024*1024*1024),
+		ClientTimeout:        time.Duration(getEnvInt("UPSTREAM_TIMEOUT_SEC", 10)) * time.Second,
+		AlwaysOnline:         time.Duration(getEnvInt("EDGE_ALWAYS_ONLINE_SEC", 0)) * time.Second,
+		HeuristicPercent:     getEnvInt64("EDGE_HEURISTIC_PERCENT", 10),
+		HeuristicMax:         time.Duration(getEnvInt("EDGE_HEURISTIC_MAX_SEC", 24*60*60)) * time.Second,
+		TTLRules:             strings.TrimSpace(os.Getenv("EDGE_TTL_RULES")),
+		ValidationWindow:     time.Duration(getEnvInt("EDGE_REVALIDATE_KEEP_SEC", 24*60*60)) * time.Second,
+		ExposeSurrogateKeys:  getEnvBool("EDGE_EXPOSE_SURROGATE_KEYS", false),
+		ClientCacheControl:   getEnv("EDGE_CLIENT_CACHE_CONTROL", string(ClientCacheHonor)),
+		CacheKeyRules:        strings.TrimSpace(os.Getenv("EDGE_CACHE_KEY_RULES")),
+		VaryEncodings:        splitCSV(getEnv("EDGE_VARY_ENCODINGS", "br,gzip")),
+		VaryLanguages:        splitCSV(os.Getenv("EDGE_VARY_LANGUAGES")),
+		MaxVariants:          getEnvInt("EDGE_MAX_VARIANTS", 32),
+		CompressEncodings:    splitCSV(os.Getenv("EDGE_COMPRESS_ENCODINGS")),
+		CompressTypes:        splitCSV(os.Getenv("EDGE_COMPRESS_TYPES")),
+		CompressMinBytes:     getEnvInt64("EDGE_COMPRESS_MIN_BYTES", 1024),
+		CompressMaxBytes:     getEnvInt64("EDGE_COMPRESS_MAX_BYTES", 8*1024*1024),
+		MaxRanges:            getEnvInt("EDGE_MAX_RANGES", 16),
+		SliceBytes:           getEnvInt64("EDGE_SLICE_BYTES", 0),
+		DiskPromoteMaxBytes:  getEnvInt64("EDGE_DISK_PROMOTE_MAX_BYTES", 1024*1024),
+		SharedBodyMaxBytes:   getEnvInt64("EDGE_SHARED_BODY_MAX_BYTES", 8*1024*1024),
+		DiskWriters:          getEnvInt("EDGE_DISK_WRITERS", 4),
+		DiskWriteQueue:       getEnvInt("EDGE_DISK_WRITE_QUEUE", 256),
+		DiskEvictHighPercent: getEnvInt("EDGE_DISK_EVICT_HIGH_PERCENT", 95),
+		DiskEvictLowPercent:  getEnvInt("EDGE_DISK_EVICT_LOW_PERCENT", 85),
+		DiskTagPriority:      strings.TrimSpace(os.Getenv("EDGE_DISK_TAG_PRIORITY")),
+		DiskAccessFlush:      time.Duration(getEnvInt("EDGE_DISK_ACCESS_FLUSH_SEC", 30)) * time.Second,
+		InsecureUpstreamTL:   getEnvBool("UPSTREAM_INSECURE_TLS", false),
+		TLSCertFile:          strings.TrimSpace(os.Getenv("EDGE_TLS_CERT_FILE")),
+		TLSKeyFile:           strings.TrimSpace(os.Getenv("EDGE_TLS_KEY_FILE")),
+		AdminListenAddr:      strings.TrimSpace(os.Getenv("EDGE_ADMIN_LISTEN_ADDR")),
+		AdminToken:           strings.TrimSpace(os.Getenv("EDGE_ADMIN_TOKEN")),
 	}
 }
 
+// newUpstreamClient builds the client for origin and shield requests. The
+// timeout bounds connecting and waiting for response headers; bodies are
+// streamed for as long as they keep arriving, see EdgeServer.doUpstream.
 func newUpstreamClient(cfg EdgeConfig) *http.Client {
 	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: cfg.ClientTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   cfg.ClientTimeout,
+		ResponseHeaderTimeout: cfg.ClientTimeout,
 		TLSClientConfig: &tls.Config{
 			MinVersion:         tls.VersionTLS12,
 			InsecureSkipVerify: cfg.InsecureUpstreamTL,
 		},
 	}
-	return &http.Client{
-		Timeout:   cfg.ClientTimeout,
-		Transport: tr,
-	}
+	return &http.Client{Transport: tr}
 }
 
 func getEnv(key, fallback string) string {
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessJournalName is the file in the cache directory disk hits are
+// recorded in, one "<file hash> <unix nanoseconds>" line per access.
+const accessJournalName = "access.journal"
+
+// journalCompactMin is how many lines the journal may hold beyond twice the
+// number of indexed entries before it is rewritten.
+const journalCompactMin = 100000
+
+// StartAccessFlusher appends the access times of disk hits to the access
+// journal every interval, in one write, instead of each hit rewriting the
+// entry's metadata. The index rebuild reads the journal back, so eviction
+// order survives a restart; at most one interval of accesses is lost in a
+// crash. Without it, access times are kept in memory only.
+func (d *DiskCache) StartAccessFlusher(interval time.Duration) {
+	if d == nil || interval <= 0 {
+		return
+	}
+	d.mu.Lock()
+	d.touched = make(map[string]time.Time)
+	d.mu.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := d.FlushAccesses(); err != nil {
+				log.Printf("disk cache: writing access journal: %v", err)
+			}
+		}
+	}()
+}
+
+// FlushAccesses appends the accesses recorded since the last flush to the
+// journal. Once the journal has grown well past the index, or after an
+// index rebuild, it is rewritten from the index instead.
+func (d *DiskCache) FlushAccesses() error {
+	if d == nil {
+		return nil
+	}
+	d.journalMu.Lock()
+	defer d.journalMu.Unlock()
+
+	d.mu.Lock()
+	touched := d.touched
+	if touched == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	d.touched = make(map[string]time.Time, len(touched))
+	compact := !d.rebuilding && (d.compactJournal || d.journalLines > 2*len(d.index)+journalCompactMin)
+	if compact {
+		// The index already has every access in touched.
+		touched = make(map[string]time.Time, len(d.index))
+		for key, meta := range d.index {
+			touched[key] = meta.LastAccessed
+		}
+		d.compactJournal = false
+	}
+	d.mu.Unlock()
+
+	var buf []byte
+	for key, at := range touched {
+		buf = append(buf, safeKey(key)...)
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, at.UnixNano(), 10)
+		buf = append(buf, '\n')
+	}
+	if compact {
+		if err := writeFileAtomic(d.journalPath(), buf, true); err != nil {
+			return err
+		}
+		d.journalLines = len(touched)
+		return nil
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(d.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	d.journalLines += len(touched)
+	return err
+}
+
+// loadAccessJournal reads the journal for the index rebuild and applies it
+// to entries already indexed; indexLocked applies it to the rest. A line
+// torn by a crash is skipped.
+func (d *DiskCache) loadAccessJournal() {
+	d.journalMu.Lock()
+	defer d.journalMu.Unlock()
+
+	f, err := os.Open(d.journalPath())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	times := make(map[string]time.Time)
+	lines := 0
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		hash, raw, ok := strings.Cut(sc.Text(), " ")
+		ns, err := strconv.ParseInt(raw, 10, 64)
+		if !ok || err != nil {
+			continue
+		}
+		lines++
+		if at := time.Unix(0, ns); at.After(times[hash]) {
+			times[hash] = at
+		}
+	}
+	d.journalLines = lines
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.journalTimes = times
+	for _, meta := range d.index {
+		if d.applyJournalLocked(meta) {
+			d.accessedLocked(meta)
+		}
+	}
+}
+
+// applyJournalLocked moves meta's LastAccessed up to the journal's record of
+// it and reports whether it changed.
+func (d *DiskCache) applyJournalLocked(meta *diskMeta) bool {
+	at, ok := d.journalTimes[safeKey(meta.Key)]
+	if !ok || !at.After(meta.LastAccessed) {
+		return false
+	}
+	meta.LastAccessed = at
+	return true
+}
+
+func (d *DiskCache) journalPath() string {
+	return filepath.Join(d.dir, accessJournalName)
+}
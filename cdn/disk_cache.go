@@ -2,23 +2,74 @@ package main
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// quarantineDir is the subdirectory corrupt entries are moved to.
+const quarantineDir = "quarantine"
+
+// DiskCache is the disk tier. mu guards the index and the files' metadata;
+// reads of a body take only the key's lock from keyLock, shared, and writes
+// go through the pool started by StartWriters.
 type DiskCache struct {
 	mu          sync.Mutex
 	dir         string
 	maxBytes    int64
 	currentSize int64
+	staleFloor  time.Duration
 	index       map[string]*diskMeta
+	tags        map[string]map[string]struct{}
+
+	// rebuilding is set while StartIndexRebuild scans the directory;
+	// pendingPurges holds the purges issued meanwhile, and rebuildRemoved
+	// the keys removed. indexComplete is set once it has scanned all of it:
+	// from then on, a key missing from the index is not on disk either.
+	rebuilding     bool
+	indexComplete  bool
+	pendingPurges  []diskPurge
+	rebuildRemoved map[string]struct{}
+
+	keyLocks [keyLockStripes]sync.RWMutex
+	// pending holds the writes not yet committed, by key; jobs feeds them to
+	// the write pool.
+	pending map[string]*diskJob
+	jobs    chan *diskJob
+	// verifyQueue feeds the bodies still to be checked against their
+	// checksum to the background verifier, if StartVerifier started one.
+	verifyQueue chan *diskMeta
+
+	// evictQueue orders the entries for eviction, which starts past
+	// highWater and goes down to lowWater; evictKick wakes the background
+	// evictor if there is one.
+	evictQueue          diskEvictQueue
+	highWater, lowWater int64
+	evictKick           chan struct{}
+	tagPriority         map[string]diskPriority
+	pinnedSize          int64
+
+	// touched holds the accesses not yet in the access journal, by key;
+	// journalTimes holds the journal's records while the index is rebuilt.
+	// journalMu serializes writes to the journal, and guards journalLines.
+	touched        map[string]time.Time
+	journalTimes   map[string]time.Time
+	compactJournal bool
+	journalMu      sync.Mutex
+	journalLines   int
+
+	written, dropped, failed, evicted atomic.Int64
 }
 
 type diskMeta struct {
@@ -31,6 +82,93 @@ type diskMeta struct {
 	LastModified string              `json:"last_modified"`
 	SizeBytes    int64               `json:"size_bytes"`
 	LastAccessed time.Time           `json:"last_accessed"`
+	Tags         []string            `json:"tags,omitempty"`
+	InitialAge   time.Duration       `json:"initial_age,omitempty"`
+
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+	SoftPurged           bool          `json:"soft_purged,omitempty"`
+	KeepUntil            time.Time     `json:"keep_until,omitempty"`
+	MustRevalidate       bool          `json:"must_revalidate,omitempty"`
+	ValidationWindow     time.Duration `json:"validation_window,omitempty"`
+
+	// Checksum is the CRC-32C of the body, in hex. Entries written before
+	// checksums were recorded have none and are not verified.
+	Checksum string `json:"checksum,omitempty"`
+	// verified is set once the body has been checked against Checksum in
+	// this process; verifying while it waits for or undergoes a check in
+	// the background.
+	verified, verifying bool
+	// priority and heapIndex place the entry in the eviction queue;
+	// heapIndex is -1 when it is not in it.
+	priority  diskPriority
+	heapIndex int
+	// version counts changes made to the metadata in memory; persisted is
+	// the last version written to its file.
+	version, persisted uint64
+}
+
+func newDiskMeta(key string, entry *CacheEntry, size int64) *diskMeta {
+	return &diskMeta{
+		Key:                  key,
+		Header:               map[string][]string(entry.header.Clone()),
+		StatusCode:           entry.statusCode,
+		CreatedAt:            entry.createdAt,
+		ExpiresAt:            entry.expiresAt,
+		ETag:                 entry.eTag,
+		LastModified:         entry.lastModified,
+		SizeBytes:            size,
+		LastAccessed:         time.Now(),
+		Tags:                 append([]string(nil), entry.tags...),
+		InitialAge:           entry.initialAge,
+		StaleWhileRevalidate: entry.staleWhileRevalidate,
+		StaleIfError:         entry.staleIfError,
+		SoftPurged:           entry.softPurged,
+		KeepUntil:            entry.keepUntil,
+		MustRevalidate:       entry.mustRevalidate,
+		ValidationWindow:     entry.validationWindow,
+	}
+}
+
+func (m *diskMeta) entry(body []byte) *CacheEntry {
+	return &CacheEntry{
+		data:                 body,
+		header:               http.Header(m.Header).Clone(),
+		statusCode:           m.StatusCode,
+		createdAt:            m.CreatedAt,
+		expiresAt:            m.ExpiresAt,
+		eTag:                 m.ETag,
+		lastModified:         m.LastModified,
+		sizeBytes:            m.SizeBytes,
+		tags:                 append([]string(nil), m.Tags...),
+		initialAge:           m.InitialAge,
+		staleWhileRevalidate: m.StaleWhileRevalidate,
+		staleIfError:         m.StaleIfError,
+		softPurged:           m.SoftPurged,
+		keepUntil:            m.KeepUntil,
+		mustRevalidate:       m.MustRevalidate,
+		validationWindow:     m.ValidationWindow,
+	}
+}
+
+func (m *diskMeta) retainUntil(alwaysOnline time.Duration) time.Time {
+	until := m.ExpiresAt.Add(m.ValidationWindow)
+	if !m.MustRevalidate {
+		until = m.ExpiresAt.Add(max(m.StaleWhileRevalidate, m.StaleIfError, alwaysOnline, m.ValidationWindow))
+	}
+	if m.KeepUntil.After(until) {
+		return m.KeepUntil
+	}
+	return until
+}
+
+// softPurge mirrors CacheEntry.softPurge for an on-disk entry.
+func (m *diskMeta) softPurge(alwaysOnline time.Duration, now time.Time) {
+	m.KeepUntil = m.retainUntil(alwaysOnline)
+	m.SoftPurged = true
+	if m.ExpiresAt.After(now) {
+		m.ExpiresAt = now.Add(-time.Second)
+	}
 }
 
 func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
@@ -41,23 +179,155 @@ func NewDiskCache(dir string, maxBytes int64) (*DiskCache, error) {
 		return nil, err
 	}
 	return &DiskCache{
-		dir:      dir,
-		maxBytes: maxBytes,
-		index:    make(map[string]*diskMeta),
+		dir:       dir,
+		maxBytes:  maxBytes,
+		highWater: maxBytes,
+		lowWater:  maxBytes,
+		index:     make(map[string]*diskMeta),
+		tags:      make(map[string]map[string]struct{}),
+		pending:   make(map[string]*diskJob),
 	}, nil
 }
 
+// SetAlwaysOnline keeps expired entries for at least dur so they can be served
+// while the origin is down.
+func (d *DiskCache) SetAlwaysOnline(dur time.Duration) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.staleFloor = dur
+}
+
 func (d *DiskCache) Get(key string) (*CacheEntry, bool) {
 	if d == nil {
 		return nil, false
 	}
+	lock := d.keyLock(key)
+	lock.RLock()
+	d.mu.Lock()
+	if job := d.pending[key]; job != nil {
+		d.mu.Unlock()
+		defer lock.RUnlock()
+		return job.entry()
+	}
+	meta, ok := d.lookupLocked(key, false)
+	var entry *CacheEntry
+	var checksum string
+	if ok {
+		entry, checksum = meta.entry(nil), meta.Checksum
+	}
+	d.mu.Unlock()
+	if !ok {
+		lock.RUnlock()
+		return nil, false
+	}
+	body, err := os.ReadFile(d.bodyPath(key))
+	lock.RUnlock()
+	if err != nil {
+		return nil, false
+	}
+	valid := checksum == "" || bodyChecksum(body) == checksum
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !valid {
+		d.quarantineIfCurrentLocked(key, meta, "checksum mismatch")
+		return nil, false
+	}
+	if d.index[key] == meta {
+		meta.verified = true
+		d.touchLocked(key, meta)
+	}
+	entry.data = body
+	return entry, true
+}
+
+// Open is Get without reading the body: the entry has no data, and its body
+// is left in the returned file for the caller to read from and close. The
+// first Open of the entry has its body verified: in the background once
+// StartVerifier has been called, and otherwise by reading it through first.
+func (d *DiskCache) Open(key string) (*CacheEntry, *diskBody, bool) {
+	return d.open(key, false)
+}
+
+// OpenStale is Open for an entry that may have expired, as long as it is
+// still inside its stale retention window.
+func (d *DiskCache) OpenStale(key string) (*CacheEntry, *diskBody, bool) {
+	return d.open(key, true)
+}
+
+func (d *DiskCache) open(key string, allowStale bool) (*CacheEntry, *diskBody, bool) {
+	if d == nil {
+		return nil, nil, false
+	}
+	lock := d.keyLock(key)
+	lock.RLock()
+	d.mu.Lock()
+	if job := d.pending[key]; job != nil {
+		d.mu.Unlock()
+		defer lock.RUnlock()
+		return job.open(allowStale)
+	}
+	meta, ok := d.lookupLocked(key, allowStale)
+	var entry *CacheEntry
+	var checksum string
+	verify := false
+	if ok {
+		entry, checksum = meta.entry(nil), meta.Checksum
+		verify = !meta.verified && checksum != ""
+		if verify && d.verifyQueue != nil {
+			d.queueVerifyLocked(meta)
+			verify = false
+		}
+	}
+	d.mu.Unlock()
+	if !ok {
+		lock.RUnlock()
+		return nil, nil, false
+	}
+	// Once open, the file stays the one meta describes whatever is renamed
+	// over its path, so the key lock can go.
+	f, err := os.Open(d.bodyPath(key))
+	lock.RUnlock()
+	if err != nil {
+		return nil, nil, false
+	}
+
+	problem := ""
+	if fi, err := f.Stat(); err != nil || fi.Size() != entry.sizeBytes {
+		problem = "body size does not match metadata"
+	} else if verify {
+		if sum, err := fileChecksum(f); err != nil || sum != checksum {
+			problem = "checksum mismatch"
+		}
+	}
+
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if problem != "" {
+		_ = f.Close()
+		d.quarantineIfCurrentLocked(key, meta, problem)
+		return nil, nil, false
+	}
+	if d.index[key] == meta {
+		meta.verified = true
+		d.touchLocked(key, meta)
+	}
+	entry.onDisk = true
+	return entry, &diskBody{File: f, size: entry.sizeBytes}, true
+}
 
+// lookupLocked returns the metadata of key, loading it into the index if
+// needed. Entries past their retention are removed.
+func (d *DiskCache) lookupLocked(key string, allowStale bool) (*diskMeta, bool) {
 	meta := d.index[key]
 	if meta == nil {
-		metaPath := d.metaPath(key)
-		rawMeta, err := os.ReadFile(metaPath)
+		if d.indexComplete {
+			return nil, false
+		}
+		rawMeta, err := os.ReadFile(d.metaPath(key))
 		if err != nil {
 			return nil, false
 		}
@@ -65,103 +335,463 @@ func (d *DiskCache) Get(key string) (*CacheEntry, bool) {
 		if err := json.Unmarshal(rawMeta, meta); err != nil {
 			return nil, false
 		}
-		d.index[key] = meta
+		if !d.indexLocked(meta) {
+			d.removeLocked(key)
+			return nil, false
+		}
+		if meta.persisted < meta.version {
+			// The caller holds the lock, so the soft-purge marker is
+			// written from another goroutine.
+			go d.persistExpired([]*diskMeta{meta})
+		}
 	}
 
-	if meta.ExpiresAt.Before(time.Now()) {
-		d.removeLocked(key)
-		return nil, false
+	now := time.Now()
+	if meta.ExpiresAt.Before(now) {
+		if meta.retainUntil(d.staleFloor).Before(now) {
+			d.removeLocked(key)
+			return nil, false
+		}
+		if !allowStale {
+			return nil, false
+		}
 	}
+	return meta, true
+}
 
-	body, err := os.ReadFile(d.bodyPath(key))
-	if err != nil {
-		return nil, false
-	}
+// touchLocked records an access in memory, for the access flusher to write
+// out with the others.
+func (d *DiskCache) touchLocked(key string, meta *diskMeta) {
 	meta.LastAccessed = time.Now()
-	_ = d.writeMetaLocked(key, meta)
-
-	return &CacheEntry{
-		data:         body,
-		header:       http.Header(meta.Header),
-		statusCode:   meta.StatusCode,
-		createdAt:    meta.CreatedAt,
-		expiresAt:    meta.ExpiresAt,
-		eTag:         meta.ETag,
-		lastModified: meta.LastModified,
-		sizeBytes:    meta.SizeBytes,
-	}, true
+	d.accessedLocked(meta)
+	if d.touched != nil {
+		d.touched[key] = meta.LastAccessed
+	}
 }
 
-func (d *DiskCache) Set(key string, entry *CacheEntry) {
+// UpdateFreshness replaces the metadata of a stored entry after a successful
+// revalidation, leaving the body untouched. The index has the new metadata
+// right away; its file is rewritten by the write pool.
+func (d *DiskCache) UpdateFreshness(key string, entry *CacheEntry) {
 	if d == nil || entry == nil {
 		return
 	}
 	d.mu.Lock()
-	defer d.mu.Unlock()
-
-	meta := &diskMeta{
-		Key:          key,
-		Header:       map[string][]string(entry.header.Clone()),
-		StatusCode:   entry.statusCode,
-		CreatedAt:    entry.createdAt,
-		ExpiresAt:    entry.expiresAt,
-		ETag:         entry.eTag,
-		LastModified: entry.lastModified,
-		SizeBytes:    int64(len(entry.data)),
-		LastAccessed: time.Now(),
+	meta := d.index[key]
+	if meta == nil {
+		d.mu.Unlock()
+		return
 	}
+	updated := newDiskMeta(key, entry, meta.SizeBytes)
+	updated.Checksum, updated.verified = meta.Checksum, meta.verified
+	updated.version = 1
+	d.unindexTagsLocked(key, meta.Tags)
+	d.untrackLocked(meta)
+	d.index[key] = updated
+	d.indexTagsLocked(key, updated.Tags)
+	d.trackLocked(updated)
+	d.mu.Unlock()
 
-	if err := os.WriteFile(d.bodyPath(key), entry.data, 0o644); err != nil {
+	d.enqueueMeta(updated)
+}
+
+// Set stores entry in the background; see StartWriters. The body is replaced
+// by rename, never rewritten in place, so readers holding the old file from
+// Open keep seeing a complete body.
+func (d *DiskCache) Set(key string, entry *CacheEntry) {
+	if d == nil || entry == nil {
 		return
 	}
-	if err := d.writeMetaLocked(key, meta); err != nil {
-		return
+
+	meta := newDiskMeta(key, entry, int64(len(entry.data)))
+	meta.Checksum, meta.verified = bodyChecksum(entry.data), true
+	d.enqueue(&diskJob{key: key, meta: meta, data: entry.data})
+}
+
+// NewWriter opens a temporary body file for key so an origin response can be
+// written to disk while it streams. Nothing is visible to Get until Commit.
+func (d *DiskCache) NewWriter(key string) (*diskWriter, error) {
+	if d == nil {
+		return nil, nil
 	}
+	f, err := os.CreateTemp(d.dir, safeKey(key)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &diskWriter{d: d, key: key, f: f, sum: crc32.New(castagnoli)}, nil
+}
 
+// indexCommittedLocked accounts for an entry whose files were just renamed
+// into place, replacing any earlier version of it.
+func (d *DiskCache) indexCommittedLocked(key string, meta *diskMeta) {
 	if old := d.index[key]; old != nil {
 		d.currentSize -= old.SizeBytes
+		d.unindexTagsLocked(key, old.Tags)
+		d.untrackLocked(old)
 	}
 	d.index[key] = meta
+	d.indexTagsLocked(key, meta.Tags)
+	d.trackLocked(meta)
 	d.currentSize += meta.SizeBytes
 	d.evictIfNeededLocked()
 }
 
-func (d *DiskCache) writeMetaLocked(key string, meta *diskMeta) error {
-	raw, err := json.Marshal(meta)
-	if err != nil {
+type diskWriter struct {
+	d    *DiskCache
+	key  string
+	f    *os.File
+	size int64
+	sum  hash.Hash32
+}
+
+func (w *diskWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	w.sum.Write(p[:n])
+	return n, err
+}
+
+// Commit hands the streamed body to the write pool to be moved into place
+// with its metadata. The body in entry is ignored; the size is whatever was
+// written.
+func (w *diskWriter) Commit(entry *CacheEntry) error {
+	if w == nil {
+		return nil
+	}
+	if err := w.f.Close(); err != nil {
+		_ = os.Remove(w.f.Name())
 		return err
 	}
-	return os.WriteFile(d.metaPath(key), raw, 0o644)
+	meta := newDiskMeta(w.key, entry, w.size)
+	meta.Checksum, meta.verified = hex.EncodeToString(w.sum.Sum(nil)), true
+	w.d.enqueue(&diskJob{key: w.key, meta: meta, tmp: w.f.Name()})
+	return nil
 }
 
-func (d *DiskCache) evictIfNeededLocked() {
-	if d.maxBytes <= 0 {
+// Abort discards a partially written body.
+func (w *diskWriter) Abort() {
+	if w == nil {
 		return
 	}
-	for d.currentSize > d.maxBytes {
-		var items []*diskMeta
-		for _, m := range d.index {
-			items = append(items, m)
+	_ = w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
+
+// Delete removes one entry.
+func (d *DiskCache) Delete(key string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, key)
+	d.removeLocked(key)
+}
+
+// DeleteMatching removes every indexed entry whose key satisfies match and
+// returns the removed keys.
+func (d *DiskCache) DeleteMatching(match func(key string) bool) []string {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deferPurgeLocked(keyPurge(match), false)
+	removed := d.dropPendingLocked(keyPurge(match))
+	for key := range d.index {
+		if match(key) {
+			d.removeLocked(key)
+			removed = append(removed, key)
+		}
+	}
+	return removed
+}
+
+// ExpireMatching soft-purges every indexed entry whose key satisfies match and
+// returns the affected keys.
+func (d *DiskCache) ExpireMatching(match func(key string) bool) []string {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.deferPurgeLocked(keyPurge(match), true)
+	dropped := d.dropPendingLocked(keyPurge(match))
+	var keys []string
+	for key := range d.index {
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	expired := d.expireLocked(keys)
+	d.mu.Unlock()
+
+	return append(dropped, d.persistExpired(expired)...)
+}
+
+// ExpireTag soft-purges every indexed entry tagged with tag and returns the
+// affected keys.
+func (d *DiskCache) ExpireTag(tag string) []string {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	d.deferPurgeLocked(tagPurge(tag), true)
+	dropped := d.dropPendingLocked(tagPurge(tag))
+	var keys []string
+	for key := range d.tags[tag] {
+		keys = append(keys, key)
+	}
+	expired := d.expireLocked(keys)
+	d.mu.Unlock()
+
+	return append(dropped, d.persistExpired(expired)...)
+}
+
+// expireLocked soft-purges the entries of keys in memory and returns their
+// metadata, for persistExpired to write out once the lock is released.
+func (d *DiskCache) expireLocked(keys []string) []*diskMeta {
+	now := time.Now()
+	var expired []*diskMeta
+	for _, key := range keys {
+		meta := d.index[key]
+		if meta == nil {
+			continue
+		}
+		meta.softPurge(d.staleFloor, now)
+		meta.version++
+		expired = append(expired, meta)
+	}
+	return expired
+}
+
+// persistExpired writes the soft-purge markers of expired and returns their
+// keys. It runs without the lock held, so a large purge does not stall
+// lookups while every marker is synced to disk.
+func (d *DiskCache) persistExpired(expired []*diskMeta) []string {
+	keys := make([]string, 0, len(expired))
+	for _, meta := range expired {
+		if err := d.persistMeta(meta); err != nil {
+			// Without the on-disk marker the entry would come back fresh
+			// after a restart; drop it instead.
+			d.mu.Lock()
+			if d.index[meta.Key] == meta {
+				d.removeLocked(meta.Key)
+			}
+			d.mu.Unlock()
+		}
+		keys = append(keys, meta.Key)
+	}
+	return keys
+}
+
+// DeleteTag removes every indexed entry tagged with tag and returns the
+// removed keys.
+func (d *DiskCache) DeleteTag(tag string) []string {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deferPurgeLocked(tagPurge(tag), false)
+	removed := d.dropPendingLocked(tagPurge(tag))
+	for key := range d.tags[tag] {
+		d.removeLocked(key)
+		removed = append(removed, key)
+	}
+	delete(d.tags, tag)
+	return removed
+}
+
+func (d *DiskCache) indexTagsLocked(key string, tags []string) {
+	for _, tag := range tags {
+		keys := d.tags[tag]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			d.tags[tag] = keys
 		}
-		if len(items) == 0 {
-			return
+		keys[key] = struct{}{}
+	}
+}
+
+func (d *DiskCache) unindexTagsLocked(key string, tags []string) {
+	for _, tag := range tags {
+		keys := d.tags[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(d.tags, tag)
+		}
+	}
+}
+
+// persistMeta durably writes meta to its file. It is marshalled under the
+// lock but written and synced outside it, then renamed into place under the
+// key lock, unless the entry was replaced or removed meanwhile or a later
+// version of it was written first.
+func (d *DiskCache) persistMeta(meta *diskMeta) error {
+	key := meta.Key
+	d.mu.Lock()
+	if d.index[key] != meta {
+		d.mu.Unlock()
+		return nil
+	}
+	version := meta.version
+	raw, err := json.Marshal(meta)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := stageFile(d.metaPath(key), raw, true)
+	if err != nil {
+		return err
+	}
+
+	lock := d.keyLock(key)
+	lock.Lock()
+	d.mu.Lock()
+	renamed := false
+	if d.index[key] == meta && meta.persisted < version {
+		if err = os.Rename(tmp, d.metaPath(key)); err == nil {
+			meta.persisted, renamed = version, true
 		}
-		sort.Slice(items, func(i, j int) bool {
-			return items[i].LastAccessed.Before(items[j].LastAccessed)
-		})
-		d.removeLocked(items[0].Key)
 	}
+	d.mu.Unlock()
+	lock.Unlock()
+
+	if !renamed {
+		_ = os.Remove(tmp)
+		return err
+	}
+	syncDir(d.dir)
+	return nil
+}
+
+// quarantineLocked moves the files of a corrupt entry into the quarantine
+// directory, where they are kept for inspection, and forgets the entry.
+func (d *DiskCache) quarantineLocked(key, reason string) {
+	log.Printf("disk cache: quarantining %q: %s", key, reason)
+	d.quarantineFiles(safeKey(key))
+	d.removeLocked(key)
+}
+
+// quarantineIfCurrentLocked quarantines key if meta still describes it; a
+// reader that found a problem without the lock may have raced a new write.
+func (d *DiskCache) quarantineIfCurrentLocked(key string, meta *diskMeta, reason string) {
+	if d.index[key] == meta {
+		d.quarantineLocked(key, reason)
+	}
+}
+
+// quarantineFiles moves the files stored under the name hash aside. The
+// caller holds d.mu or the key's lock, so that no write renames new files
+// into place meanwhile.
+func (d *DiskCache) quarantineFiles(hash string) {
+	dir := filepath.Join(d.dir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	for _, ext := range []string{".body", ".meta"} {
+		_ = os.Rename(filepath.Join(d.dir, hash+ext), filepath.Join(dir, hash+ext))
+	}
+}
+
+// writeFileAtomic replaces path with data through a temp file renamed into
+// place, so readers and a crash see either the old file or the new one. With
+// durable set the data is synced to disk before the rename.
+func writeFileAtomic(path string, data []byte, durable bool) error {
+	tmp, err := stageFile(path, data, durable)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil && tmp != "" {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// stageFile writes data to a temp file next to path, for renaming over it
+// later, and returns the temp file's name. With durable set it is synced.
+func stageFile(path string, data []byte, durable bool) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil && durable {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) {
+	if f, err := os.Open(dir); err == nil {
+		_ = f.Sync()
+		_ = f.Close()
+	}
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func bodyChecksum(body []byte) string {
+	sum := crc32.Checksum(body, castagnoli)
+	return hex.EncodeToString(binary.BigEndian.AppendUint32(nil, sum))
+}
+
+// fileChecksum is bodyChecksum of the rest of f.
+func fileChecksum(f *os.File) (string, error) {
+	sum := crc32.New(castagnoli)
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
 }
 
 func (d *DiskCache) removeLocked(key string) {
 	if meta := d.index[key]; meta != nil {
 		d.currentSize -= meta.SizeBytes
+		d.unindexTagsLocked(key, meta.Tags)
+		d.untrackLocked(meta)
 	}
 	delete(d.index, key)
+	if d.rebuilding {
+		d.rebuildRemoved[key] = struct{}{}
+	}
+	d.removeFiles(key)
+}
+
+// removeFiles deletes the files of key. The caller holds d.mu or the key's
+// lock, as for quarantineFiles.
+func (d *DiskCache) removeFiles(key string) {
 	_ = os.Remove(d.bodyPath(key))
 	_ = os.Remove(d.metaPath(key))
 }
 
+// diskBody is the body file of a disk entry handed out by Open.
+type diskBody struct {
+	*os.File
+	size int64
+}
+
+// Size is the length of the body.
+func (b *diskBody) Size() int64 { return b.size }
+
+// Close closes the file; a nil body is a no-op so callers need not check.
+func (b *diskBody) Close() error {
+	if b == nil {
+		return nil
+	}
+	return b.File.Close()
+}
+
 func (d *DiskCache) bodyPath(key string) string {
 	return filepath.Join(d.dir, safeKey(key)+".body")
 }
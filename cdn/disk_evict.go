@@ -0,0 +1,203 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+)
+
+// evictBatch is how many entries the background evictor removes per hold of
+// the lock, so requests are not stalled behind a long eviction run.
+const evictBatch = 64
+
+// diskPriority ranks disk entries for eviction: lower priorities go first,
+// and pinned entries are never evicted.
+type diskPriority int
+
+const (
+	priorityLow diskPriority = iota - 1
+	priorityNormal
+	priorityHigh
+	priorityPin
+)
+
+// diskEvictQueue is a heap of the evictable disk entries, lowest priority
+// and then least recently accessed on top.
+type diskEvictQueue []*diskMeta
+
+func (q diskEvictQueue) Len() int { return len(q) }
+
+func (q diskEvictQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority < q[j].priority
+	}
+	return q[i].LastAccessed.Before(q[j].LastAccessed)
+}
+
+func (q diskEvictQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].heapIndex = i
+	q[j].heapIndex = j
+}
+
+func (q *diskEvictQueue) Push(x any) {
+	meta := x.(*diskMeta)
+	meta.heapIndex = len(*q)
+	*q = append(*q, meta)
+}
+
+func (q *diskEvictQueue) Pop() any {
+	old := *q
+	meta := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	meta.heapIndex = -1
+	return meta
+}
+
+// SetTagPriorities sets the eviction priority of entries by their tags; an
+// entry takes the highest priority among its tags. It must be called before
+// the cache is used.
+func (d *DiskCache) SetTagPriorities(priorities map[string]diskPriority) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tagPriority = priorities
+}
+
+// SetEvictionWatermarks makes eviction start once usage passes highPercent
+// of the size limit and run until it is back under lowPercent.
+func (d *DiskCache) SetEvictionWatermarks(highPercent, lowPercent int) error {
+	if d == nil {
+		return nil
+	}
+	if lowPercent <= 0 || lowPercent > highPercent || highPercent > 100 {
+		return fmt.Errorf("need 0 < low <= high <= 100, got high=%d low=%d", highPercent, lowPercent)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.highWater = d.maxBytes * int64(highPercent) / 100
+	d.lowWater = d.maxBytes * int64(lowPercent) / 100
+	return nil
+}
+
+// StartEvictor moves eviction between the watermarks into the background.
+// Writes that take the cache past its size limit still evict inline. It must
+// be called before the cache is used.
+func (d *DiskCache) StartEvictor() {
+	if d == nil || d.maxBytes <= 0 {
+		return
+	}
+	d.evictKick = make(chan struct{}, 1)
+	go func() {
+		for range d.evictKick {
+			for {
+				d.mu.Lock()
+				done := d.evictToLocked(d.lowWater, evictBatch)
+				d.mu.Unlock()
+				if done {
+					break
+				}
+			}
+		}
+	}()
+}
+
+// evictIfNeededLocked starts eviction once usage passes the high watermark.
+func (d *DiskCache) evictIfNeededLocked() {
+	if d.maxBytes <= 0 || d.currentSize <= d.highWater {
+		return
+	}
+	if d.evictKick != nil && d.currentSize <= d.maxBytes {
+		select {
+		case d.evictKick <- struct{}{}:
+		default:
+		}
+		return
+	}
+	d.evictToLocked(d.lowWater, 0)
+}
+
+// evictToLocked evicts entries until usage is at most target, at most limit
+// of them when limit > 0. It reports whether it is done: usage reached the
+// target or only pinned entries are left.
+func (d *DiskCache) evictToLocked(target int64, limit int) bool {
+	for n := 0; d.currentSize > target; n++ {
+		if limit > 0 && n == limit {
+			return false
+		}
+		if len(d.evictQueue) == 0 {
+			return true
+		}
+		victim := heap.Pop(&d.evictQueue).(*diskMeta)
+		d.removeLocked(victim.Key)
+		d.evicted.Add(1)
+	}
+	return true
+}
+
+// trackLocked makes a newly indexed entry a candidate for eviction, unless
+// its tags pin it.
+func (d *DiskCache) trackLocked(meta *diskMeta) {
+	meta.priority = priorityNormal
+	found := false
+	for _, tag := range meta.Tags {
+		if p, ok := d.tagPriority[tag]; ok && (!found || p > meta.priority) {
+			meta.priority, found = p, true
+		}
+	}
+	if meta.priority == priorityPin {
+		meta.heapIndex = -1
+		d.pinnedSize += meta.SizeBytes
+		return
+	}
+	heap.Push(&d.evictQueue, meta)
+}
+
+// untrackLocked undoes trackLocked for an entry leaving the index.
+func (d *DiskCache) untrackLocked(meta *diskMeta) {
+	if meta.priority == priorityPin {
+		d.pinnedSize -= meta.SizeBytes
+		return
+	}
+	if meta.heapIndex >= 0 {
+		heap.Remove(&d.evictQueue, meta.heapIndex)
+	}
+}
+
+// accessedLocked reorders an entry whose LastAccessed moved.
+func (d *DiskCache) accessedLocked(meta *diskMeta) {
+	if meta.heapIndex >= 0 {
+		heap.Fix(&d.evictQueue, meta.heapIndex)
+	}
+}
+
+// parseTagPriorities reads EDGE_DISK_TAG_PRIORITY: comma-separated tag=level
+// pairs, level being low, high or pin, for example
+//
+//	thumbnails=low,logo=high,offline-page=pin
+func parseTagPriorities(raw string) (map[string]diskPriority, error) {
+	priorities := make(map[string]diskPriority)
+	for _, pair := range splitCSV(raw) {
+		tag, level, ok := strings.Cut(pair, "=")
+		tag = strings.TrimSpace(tag)
+		if !ok || tag == "" {
+			return nil, fmt.Errorf("expected tag=level, got %q", pair)
+		}
+		switch strings.ToLower(strings.TrimSpace(level)) {
+		case "low":
+			priorities[tag] = priorityLow
+		case "normal":
+			priorities[tag] = priorityNormal
+		case "high":
+			priorities[tag] = priorityHigh
+		case "pin":
+			priorities[tag] = priorityPin
+		default:
+			return nil, fmt.Errorf("tag %q: unknown priority %q", tag, level)
+		}
+	}
+	return priorities, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// rebuildProgressEvery is how many directory entries the index rebuild
+// handles between progress log lines.
+const rebuildProgressEvery = 10000
+
+// diskPurge is a purge issued while the index was still being rebuilt. It is
+// applied to every entry brought into the index afterwards, since those were
+// not there for the purge to find.
+type diskPurge struct {
+	match func(meta *diskMeta) bool
+	soft  bool
+}
+
+// scanOutcome is what the rebuild made of one .meta file.
+type scanOutcome int
+
+const (
+	scanIndexed scanOutcome = iota
+	scanKnown               // already indexed since startup
+	scanRemoved
+)
+
+// StartIndexRebuild indexes the entries an earlier run left in the cache
+// directory, so they count against the size limit and can be evicted and
+// purged. It runs in the background; until it is done, entries not yet
+// scanned are still found by lookups, which index them on the spot.
+func (d *DiskCache) StartIndexRebuild() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	d.rebuilding = true
+	d.rebuildRemoved = make(map[string]struct{})
+	d.mu.Unlock()
+	go d.rebuildIndex()
+}
+
+func (d *DiskCache) rebuildIndex() {
+	start := time.Now()
+	d.loadAccessJournal()
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		d.finishRebuild(false)
+		log.Printf("disk cache: index rebuild failed: %v", err)
+		return
+	}
+	var indexed, removed int
+	for i, file := range files {
+		name := file.Name()
+		switch {
+		case strings.HasSuffix(name, ".meta"):
+			switch d.scanMeta(strings.TrimSuffix(name, ".meta"), start) {
+			case scanIndexed:
+				indexed++
+			case scanRemoved:
+				removed++
+			}
+		case strings.HasSuffix(name, ".body"):
+			if d.removeOrphanBody(strings.TrimSuffix(name, ".body")) {
+				removed++
+			}
+		case strings.HasSuffix(name, ".tmp"):
+			// Temp files from before startup belong to writes that never
+			// finished; newer ones may be fills in progress.
+			if info, err := file.Info(); err == nil && info.ModTime().Before(start) {
+				_ = os.Remove(filepath.Join(d.dir, name))
+				removed++
+			}
+		}
+		if (i+1)%rebuildProgressEvery == 0 {
+			log.Printf("disk cache: index rebuild at %d/%d files: %d entries indexed, %d removed", i+1, len(files), indexed, removed)
+		}
+	}
+
+	entries, size := d.finishRebuild(true)
+	log.Printf("disk cache: index rebuilt in %s: %d entries indexed, %d removed; %d entries, %d bytes in use",
+		time.Since(start).Round(time.Millisecond), indexed, removed, entries, size)
+}
+
+// finishRebuild drops the purges and access times kept for the rebuild and,
+// now that the size accounting is complete, evicts down to the limit. It
+// returns the resulting entry count and size. complete reports whether the
+// whole directory was scanned, so lookups can stop looking for entries the
+// index does not have.
+func (d *DiskCache) finishRebuild(complete bool) (entries int, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rebuilding = false
+	d.indexComplete = complete
+	d.pendingPurges = nil
+	d.rebuildRemoved = nil
+	d.journalTimes = nil
+	d.compactJournal = true
+	d.evictIfNeededLocked()
+	return len(d.index), d.currentSize
+}
+
+// scanMeta indexes the entry stored under the file name hash. Entries past
+// retention are removed; unreadable ones and ones whose body does not match
+// are quarantined. The files are read and moved without d.mu, which is only
+// taken to install the result; from the read of the metadata on, the key's
+// lock keeps writes from renaming new files into place.
+func (d *DiskCache) scanMeta(hash string, now time.Time) scanOutcome {
+	raw, err := os.ReadFile(filepath.Join(d.dir, hash+".meta"))
+	if err != nil {
+		// Removed since the directory was listed.
+		return scanKnown
+	}
+	meta := &diskMeta{}
+	if err := json.Unmarshal(raw, meta); err != nil || safeKey(meta.Key) != hash {
+		// With no key there is no lock to take. A write of the entry that
+		// lands before the rename is moved aside too, costing a miss.
+		log.Printf("disk cache: quarantining %s.meta: unreadable", hash)
+		d.quarantineFiles(hash)
+		return scanRemoved
+	}
+
+	lock := d.keyLock(meta.Key)
+	lock.Lock()
+	d.mu.Lock()
+	unseen := d.unseenLocked(meta.Key)
+	d.mu.Unlock()
+	if !unseen {
+		lock.Unlock()
+		return scanKnown
+	}
+	info, err := os.Stat(d.bodyPath(meta.Key))
+	switch {
+	case err != nil || meta.retainUntil(d.staleFloor).Before(now):
+		d.removeFiles(meta.Key)
+		lock.Unlock()
+		return scanRemoved
+	case info.Size() != meta.SizeBytes:
+		log.Printf("disk cache: quarantining %q: body size does not match metadata", meta.Key)
+		d.quarantineFiles(hash)
+		lock.Unlock()
+		return scanRemoved
+	}
+
+	d.mu.Lock()
+	outcome := scanKnown
+	if d.unseenLocked(meta.Key) {
+		outcome = scanIndexed
+		if !d.indexLocked(meta) {
+			outcome = scanRemoved
+		}
+	}
+	persist := outcome == scanIndexed && meta.persisted < meta.version
+	d.mu.Unlock()
+	if outcome == scanRemoved {
+		d.removeFiles(meta.Key)
+	}
+	lock.Unlock()
+	if persist {
+		d.persistExpired([]*diskMeta{meta})
+	}
+	return outcome
+}
+
+// unseenLocked reports whether key has been neither indexed nor removed
+// since the rebuild started, so that metadata of it the scan read from disk
+// is still what the files hold.
+func (d *DiskCache) unseenLocked(key string) bool {
+	if d.index[key] != nil {
+		return false
+	}
+	_, removed := d.rebuildRemoved[key]
+	return !removed
+}
+
+// removeOrphanBody removes a body whose metadata is gone. Both files are
+// renamed into place under the lock, so holding it rules out a write in
+// between.
+func (d *DiskCache) removeOrphanBody(hash string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(d.dir, hash+".meta")); !os.IsNotExist(err) {
+		return false
+	}
+	return os.Remove(filepath.Join(d.dir, hash+".body")) == nil
+}
+
+// indexLocked adds an entry found on disk to the index and size accounting.
+// It reports false if a purge issued during the rebuild removed it instead,
+// for the caller to delete its files. One that soft-purged it leaves meta a
+// version ahead of its file, for the caller to write out with persistExpired
+// once the lock is released.
+func (d *DiskCache) indexLocked(meta *diskMeta) bool {
+	for _, p := range d.pendingPurges {
+		if !p.match(meta) {
+			continue
+		}
+		if !p.soft {
+			return false
+		}
+		meta.softPurge(d.staleFloor, time.Now())
+		meta.version++
+	}
+	d.applyJournalLocked(meta)
+	d.index[meta.Key] = meta
+	d.indexTagsLocked(meta.Key, meta.Tags)
+	d.trackLocked(meta)
+	d.currentSize += meta.SizeBytes
+	return true
+}
+
+// deferPurgeLocked keeps a purge for entries the rebuild has yet to index.
+func (d *DiskCache) deferPurgeLocked(match func(meta *diskMeta) bool, soft bool) {
+	if d.rebuilding {
+		d.pendingPurges = append(d.pendingPurges, diskPurge{match: match, soft: soft})
+	}
+}
+
+func keyPurge(match func(key string) bool) func(meta *diskMeta) bool {
+	return func(meta *diskMeta) bool { return match(meta.Key) }
+}
+
+func tagPurge(tag string) func(meta *diskMeta) bool {
+	return func(meta *diskMeta) bool { return slices.Contains(meta.Tags, tag) }
+}
@@ -0,0 +1,72 @@
+package main
+
+import "os"
+
+// verifyQueueSize bounds the bodies waiting for the background verifier.
+// Past it, an entry is queued again on a later Open.
+const verifyQueueSize = 1024
+
+// StartVerifier moves the checksum check of bodies not yet verified in this
+// process off the request path: Open hands the file out at once and a
+// background goroutine reads it through, quarantining the entry on a
+// mismatch. Without it, Open verifies inline. It must be called before the
+// cache is used.
+func (d *DiskCache) StartVerifier() {
+	if d == nil {
+		return
+	}
+	d.verifyQueue = make(chan *diskMeta, verifyQueueSize)
+	go func() {
+		for meta := range d.verifyQueue {
+			d.verifyBody(meta)
+		}
+	}()
+}
+
+// queueVerifyLocked hands meta's body to the verifier unless it is already
+// waiting for it or the queue is full.
+func (d *DiskCache) queueVerifyLocked(meta *diskMeta) {
+	if meta.verifying {
+		return
+	}
+	select {
+	case d.verifyQueue <- meta:
+		meta.verifying = true
+	default:
+	}
+}
+
+// verifyBody checks the body of the entry meta describes against its
+// checksum, and quarantines the entry if they differ.
+func (d *DiskCache) verifyBody(meta *diskMeta) {
+	key := meta.Key
+	lock := d.keyLock(key)
+	lock.RLock()
+	d.mu.Lock()
+	current, checksum := d.index[key] == meta, meta.Checksum
+	d.mu.Unlock()
+	if !current {
+		lock.RUnlock()
+		return
+	}
+	// As in open, the file stays the one meta describes once it is open.
+	f, err := os.Open(d.bodyPath(key))
+	lock.RUnlock()
+	var sum string
+	if err == nil {
+		sum, err = fileChecksum(f)
+		_ = f.Close()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	meta.verifying = false
+	switch {
+	case err != nil:
+		// Left unverified; the next Open queues it again.
+	case sum != checksum:
+		d.quarantineIfCurrentLocked(key, meta, "checksum mismatch")
+	case d.index[key] == meta:
+		meta.verified = true
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyLockStripes is how many locks the per-key locking of the disk tier is
+// spread over.
+const keyLockStripes = 256
+
+// diskJob is an entry waiting for the write pool to make it durable and
+// commit it. The body is in data (Set) or already streamed to the temp
+// file tmp (diskWriter.Commit). meta is not changed once queued.
+//
+// A metaOnly job instead writes out the metadata of an entry already in the
+// index, see enqueueMeta; it is not in pending.
+type diskJob struct {
+	key      string
+	meta     *diskMeta
+	data     []byte
+	tmp      string
+	metaOnly bool
+}
+
+// diskStats reports the state of the disk tier and its write pool.
+type diskStats struct {
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	PinnedBytes   int64 `json:"pinned_bytes"`
+	Evicted       int64 `json:"evicted"`
+	QueueDepth    int   `json:"queue_depth"`
+	QueueCapacity int   `json:"queue_capacity"`
+	Written       int64 `json:"written"`
+	Dropped       int64 `json:"dropped"`
+	Failed        int64 `json:"failed"`
+}
+
+// keyLock returns the lock serializing file replacement for key against
+// reads of it. Readers hold it shared while they read a body, so the body
+// cannot be swapped between reading the metadata and reading the file.
+func (d *DiskCache) keyLock(key string) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &d.keyLocks[h.Sum32()%keyLockStripes]
+}
+
+// StartWriters moves disk writes off the request path onto workers
+// goroutines fed by a queue of queueSize jobs. It must be called before the
+// cache is used. Without it, writes happen inline.
+func (d *DiskCache) StartWriters(workers, queueSize int) {
+	if d == nil || workers <= 0 {
+		return
+	}
+	d.jobs = make(chan *diskJob, max(queueSize, 0))
+	for range workers {
+		go func() {
+			for job := range d.jobs {
+				d.runJob(job)
+			}
+		}()
+	}
+}
+
+// Stats returns the current disk tier figures.
+func (d *DiskCache) Stats() diskStats {
+	if d == nil {
+		return diskStats{}
+	}
+	d.mu.Lock()
+	entries, size, pinned := len(d.index), d.currentSize, d.pinnedSize
+	d.mu.Unlock()
+	return diskStats{
+		Entries:       entries,
+		Bytes:         size,
+		PinnedBytes:   pinned,
+		Evicted:       d.evicted.Load(),
+		QueueDepth:    len(d.jobs),
+		QueueCapacity: cap(d.jobs),
+		Written:       d.written.Load(),
+		Dropped:       d.dropped.Load(),
+		Failed:        d.failed.Load(),
+	}
+}
+
+// enqueue hands job to the write pool. Until it is committed, reads of the
+// key are answered from the job. When the queue is full the job is dropped
+// and the entry simply not stored on disk.
+func (d *DiskCache) enqueue(job *diskJob) {
+	d.mu.Lock()
+	d.pending[job.key] = job
+	d.mu.Unlock()
+	if d.jobs == nil {
+		d.runJob(job)
+		return
+	}
+	select {
+	case d.jobs <- job:
+	default:
+		d.dropped.Add(1)
+		d.mu.Lock()
+		d.finishPendingLocked(job)
+		d.mu.Unlock()
+		job.discard()
+	}
+}
+
+// enqueueMeta hands the write of an indexed entry's metadata file to the
+// write pool. When the queue is full it is dropped, and the file keeps the
+// previous metadata, which is all a restart would lose.
+func (d *DiskCache) enqueueMeta(meta *diskMeta) {
+	job := &diskJob{key: meta.Key, meta: meta, metaOnly: true}
+	if d.jobs == nil {
+		d.runJob(job)
+		return
+	}
+	select {
+	case d.jobs <- job:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// runJob writes and syncs the job's files outside any lock, then renames
+// them into place and indexes the entry, unless a newer write or a purge of
+// the key came in meanwhile.
+func (d *DiskCache) runJob(job *diskJob) {
+	if job.metaOnly {
+		if err := d.persistMeta(job.meta); err != nil {
+			d.failed.Add(1)
+		} else {
+			d.written.Add(1)
+		}
+		return
+	}
+	d.mu.Lock()
+	current := d.pending[job.key] == job
+	d.mu.Unlock()
+	if !current {
+		job.discard()
+		return
+	}
+
+	body, err := job.stage(d)
+	var meta string
+	if err == nil {
+		var raw []byte
+		if raw, err = json.Marshal(job.meta); err == nil {
+			meta, err = stageFile(d.metaPath(job.key), raw, true)
+		}
+	}
+	if err != nil {
+		d.failed.Add(1)
+		d.mu.Lock()
+		d.finishPendingLocked(job)
+		d.mu.Unlock()
+		removeTemp(body, meta)
+		return
+	}
+
+	lock := d.keyLock(job.key)
+	lock.Lock()
+	d.mu.Lock()
+	current = d.finishPendingLocked(job)
+	if current {
+		// The body goes first: a crash in between leaves the new body with
+		// the old metadata, which its checksum gives away.
+		if err = os.Rename(body, d.bodyPath(job.key)); err == nil {
+			err = os.Rename(meta, d.metaPath(job.key))
+		}
+		if err == nil {
+			d.indexCommittedLocked(job.key, job.meta)
+		} else {
+			d.removeLocked(job.key)
+		}
+	}
+	d.mu.Unlock()
+	lock.Unlock()
+
+	switch {
+	case !current:
+		removeTemp(body, meta)
+	case err != nil:
+		d.failed.Add(1)
+		removeTemp(body, meta)
+	default:
+		syncDir(d.dir)
+		d.written.Add(1)
+	}
+}
+
+// finishPendingLocked removes job from the pending writes and reports
+// whether it was still the one to commit for its key.
+func (d *DiskCache) finishPendingLocked(job *diskJob) bool {
+	if d.pending[job.key] != job {
+		return false
+	}
+	delete(d.pending, job.key)
+	return true
+}
+
+// dropPendingLocked cancels the queued writes match selects, for purges.
+// Nothing of them is on disk yet, so soft purges drop them as well. It
+// returns the keys of those with no earlier version indexed.
+func (d *DiskCache) dropPendingLocked(match func(meta *diskMeta) bool) []string {
+	var keys []string
+	for key, job := range d.pending {
+		if !match(job.meta) {
+			continue
+		}
+		delete(d.pending, key)
+		if d.index[key] == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// entry answers a Get from a queued write.
+func (job *diskJob) entry() (*CacheEntry, bool) {
+	if job.meta.ExpiresAt.Before(time.Now()) {
+		return nil, false
+	}
+	body := job.data
+	if job.tmp != "" {
+		var err error
+		if body, err = os.ReadFile(job.tmp); err != nil {
+			return nil, false
+		}
+	}
+	return job.meta.entry(body), true
+}
+
+// open answers an Open or OpenStale from a queued write. One still held in
+// memory has no file to hand out, so it is a miss.
+func (job *diskJob) open(allowStale bool) (*CacheEntry, *diskBody, bool) {
+	if job.tmp == "" || !allowStale && job.meta.ExpiresAt.Before(time.Now()) {
+		return nil, nil, false
+	}
+	f, err := os.Open(job.tmp)
+	if err != nil {
+		return nil, nil, false
+	}
+	entry := job.meta.entry(nil)
+	entry.onDisk = true
+	return entry, &diskBody{File: f, size: job.meta.SizeBytes}, true
+}
+
+// stage writes the job's body to a synced temp file and returns its path.
+func (job *diskJob) stage(d *DiskCache) (string, error) {
+	if job.tmp == "" {
+		return stageFile(d.bodyPath(job.key), job.data, true)
+	}
+	f, err := os.OpenFile(job.tmp, os.O_RDWR, 0)
+	if err != nil {
+		return job.tmp, err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return job.tmp, err
+}
+
+// discard removes what a dropped job left on disk.
+func (job *diskJob) discard() {
+	removeTemp(job.tmp)
+}
+
+func removeTemp(paths ...string) {
+	for _, p := range paths {
+		if p != "" {
+			_ = os.Remove(p)
+		}
+	}
+}
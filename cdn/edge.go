@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"io"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/singleflight"
@@ -18,6 +23,47 @@ type EdgeServer struct {
 	client   *http.Client
 	ring     *HashRing
 	inflight singleflight.Group
+
+	// upstreamIdle is how long an upstream body may stall before the fetch
+	// is given up; zero waits indefinitely.
+	upstreamIdle time.Duration
+	// alwaysOnline lets expired entries stand in for a failing origin even
+	// without a stale-if-error directive.
+	alwaysOnline time.Duration
+	// exposeTags keeps Surrogate-Key / Cache-Tag on client responses.
+	exposeTags bool
+	// keys normalizes cache keys per host and path.
+	keys *cacheKeyer
+	// vary normalizes the request headers responses Vary on.
+	vary *varyNormalizer
+	// compress encodes compressible responses at the edge; nil turns it off.
+	compress *compressor
+	// maxRanges caps how many ranges one Range header may ask for; beyond
+	// it the whole response is sent. Zero means no cap.
+	maxRanges int
+	// sliceSize is the size of the aligned chunks Range misses are fetched
+	// and cached in; zero sends them to origin uncached.
+	sliceSize int64
+	// noRanges holds the upstreams that answered a slice request with the
+	// whole object, until when Range misses on them fetch whole objects
+	// instead of slices.
+	noRanges sync.Map
+	// shareMax is the largest body that is not cached but still buffered
+	// for the requests that waited on its fetch; larger ones send those
+	// requests to origin themselves.
+	shareMax int64
+	// promoteMax is the largest disk entry copied into memory on a hit;
+	// larger ones are served from their file. Zero turns promotion off.
+	promoteMax int64
+	// clientCache decides which request Cache-Control directives count.
+	clientCache ClientCachePolicy
+	// ttl assigns freshness lifetimes, including defaults and heuristics
+	// for responses the origin sent none for.
+	ttl *ttlPolicy
+
+	// refreshing holds the keys with a stale-while-revalidate refresh in
+	// flight so each key gets at most one.
+	refreshing sync.Map
 }
 
 type originResult struct {
@@ -25,6 +71,22 @@ type originResult struct {
 	statusCode  int
 	body        []byte
 	cacheStatus string
+	// entry is the cached copy header and body came from, if any.
+	entry *CacheEntry
+	// streamed is set when the body went straight to the leader's client
+	// instead of being buffered in body. storeKey names the cached copy, if
+	// the fill completed, filledAt when it was stored. truncated means the
+	// origin body broke off after the leader's client got its headers.
+	// shared means body holds a copy of the streamed body for the waiters,
+	// as the tiers will not have it.
+	streamed  bool
+	truncated bool
+	shared    bool
+	storeKey  string
+	filledAt  time.Time
+	// clientDone is closed once the leader's client has been written what
+	// it gets; that goes on after the fetch, from a spool, see streamToClient.
+	clientDone chan struct{}
 }
 
 func (es *EdgeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -33,64 +95,259 @@ func (es *EdgeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	baseKey := cacheBaseKey(r)
+	r = es.compress.prepare(r)
+	es.vary.normalizeRequest(r.Header)
+	baseKey := es.keys.baseKey(r)
 	key := es.cache.LookupKey(baseKey, r)
+	cc := es.requestDirectives(r)
+	now := time.Now()
 
-	if entry, found := es.cache.Get(key); found {
-		serveCachedEntry(w, r, entry, "HIT")
+	if entry, found := es.cache.Get(key); found && cc.acceptsFresh(entry, now) {
+		es.serveCachedEntry(w, r, key, entry, "HIT")
 		return
 	}
 
-	if entry, found := es.disk.Get(key); found {
-		es.cache.Set(key, entry)
-		serveCachedEntry(w, r, entry, "HIT-DISK")
+	if entry, body, found := es.disk.Open(key); found {
+		entry, body = es.promote(key, entry, body)
+		if cc.acceptsFresh(entry, now) {
+			es.serveDiskEntry(w, r, key, entry, body, "HIT-DISK")
+			return
+		}
+		_ = body.Close()
+	}
+
+	// Past this point an entry is either expired or fresh but turned down by
+	// the client, in which case forbidsStale holds as well.
+	if entry, body, found := es.lookupStale(key); found {
+		if !entry.softPurged && !entry.mustRevalidate && !cc.forbidsStale(entry, now) && now.Before(entry.expiresAt.Add(entry.staleWhileRevalidate)) {
+			es.revalidateInBackground(r, baseKey, key, entry)
+			es.serveDiskEntry(w, r, key, entry, body, "STALE")
+			return
+		}
+		if cc.acceptsStale(entry, now) {
+			es.serveDiskEntry(w, r, key, entry, body, "STALE")
+			return
+		}
+		_ = body.Close()
+	}
+
+	if cc.onlyIfCached {
+		w.Header().Set("X-Cache", "MISS")
+		http.Error(w, "Not cached", http.StatusGatewayTimeout)
 		return
 	}
 
 	if r.Header.Get("Range") != "" {
-		es.serveNoCache(w, r)
+		switch {
+		case es.sliceSize <= 0 || r.Method != http.MethodGet:
+			es.serveNoCache(w, r)
+		case es.upstreamRanges(key):
+			es.serveSliced(w, r, baseKey, key, cc)
+		default:
+			es.serveMiss(w, r, baseKey, key, cc)
+		}
 		return
 	}
+	es.serveMiss(w, r, baseKey, key, cc)
+}
 
+// serveMiss answers r from one origin fetch of key shared with every
+// request missing on it at the same time. A Range request fetches the whole
+// object and is answered from the tiers once it is stored, like the
+// requests that waited on the fetch.
+func (es *EdgeServer) serveMiss(w http.ResponseWriter, r *http.Request, baseKey, key string, cc requestDirectives) {
+	ranged := r.Header.Get("Range") != ""
+	leader := false
 	result, err, _ := es.inflight.Do(key, func() (interface{}, error) {
-		if entry, found := es.cache.Get(key); found {
-			return &originResult{
-				header:      entry.header.Clone(),
-				statusCode:  entry.statusCode,
-				body:        append([]byte(nil), entry.data...),
-				cacheStatus: "HIT",
-			}, nil
+		leader = true
+		if entry, found := es.cache.Get(key); found && cc.acceptsFresh(entry, time.Now()) {
+			return entryResult(entry, "HIT"), nil
 		}
 
-		staleEntry, hasStale := es.cache.GetStale(key)
-		return es.fetchFromOrigin(r, baseKey, key, staleEntry, hasStale)
+		// Only the metadata is needed, for the validators and in case the
+		// origin fails; the body is opened again if it comes to that.
+		staleEntry, body, hasStale := es.lookupStale(key)
+		_ = body.Close()
+		if ranged {
+			full := r.Clone(withoutClientEncoding(r.Context()))
+			full.Header.Del("Range")
+			return es.fetchFromOrigin(newDiscardResponseWriter(), full, baseKey, key, staleEntry, hasStale)
+		}
+		return es.fetchFromOrigin(w, r, baseKey, key, staleEntry, hasStale)
 	})
+
+	final, _ := result.(*originResult)
+	streamedHere := leader && !ranged
+	if final != nil && final.streamed && (streamedHere || !final.shared) {
+		// The leader already wrote the body to its own client while filling
+		// the cache; everyone else picks it up from the tiers, or below from
+		// the copy shared with them when the tiers will not have it.
+		if !streamedHere {
+			es.serveFilled(w, r, final)
+			return
+		}
+		if final.clientDone != nil {
+			<-final.clientDone
+		}
+		if final.truncated {
+			// Returning would end the response cleanly and make the cut-off
+			// body look complete; reset the connection instead. This cannot
+			// happen inside Do, which would re-panic in every waiter.
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
 	if err != nil {
 		http.Error(w, "Origin fetch failed", http.StatusBadGateway)
 		return
 	}
 
-	final := result.(*originResult)
+	if final.entry != nil {
+		es.serveResultEntry(w, r, key, final.entry, final.cacheStatus)
+		return
+	}
 	copyHeaders(w.Header(), final.header)
 	w.Header().Set("X-Cache", final.cacheStatus)
-	writeResponseWithRange(w, r, final.statusCode, final.header, final.body)
+	es.writeResponseWithRange(w, r, final.statusCode, final.header, bytes.NewReader(final.body))
 }
 
-func serveCachedEntry(w http.ResponseWriter, r *http.Request, entry *CacheEntry, cacheStatus string) {
-	copyHeaders(w.Header(), entry.header)
-	w.Header().Set("X-Cache", cacheStatus)
-	writeResponseWithRange(w, r, entry.statusCode, entry.header, entry.data)
+// serveFilled answers a request that waited on another request's streamed
+// origin fetch.
+func (es *EdgeServer) serveFilled(w http.ResponseWriter, r *http.Request, final *originResult) {
+	if final.storeKey != "" {
+		if entry, found := es.cache.Get(final.storeKey); found {
+			es.serveCachedEntry(w, r, final.storeKey, entry, final.cacheStatus)
+			return
+		}
+		if entry, body, found := es.disk.Open(final.storeKey); found {
+			entry, body = es.promote(final.storeKey, entry, body)
+			es.serveDiskEntry(w, r, final.storeKey, entry, body, final.cacheStatus)
+			return
+		}
+		// A response stored stale for revalidation on every use is still
+		// what this request waited for.
+		if entry, body, found := es.lookupStale(final.storeKey); found {
+			if !entry.createdAt.Before(final.filledAt) {
+				es.serveDiskEntry(w, r, final.storeKey, entry, body, final.cacheStatus)
+				return
+			}
+			_ = body.Close()
+		}
+	}
+	es.serveNoCache(w, r)
 }
 
-func (es *EdgeServer) fetchFromOrigin(r *http.Request, baseKey, fallbackKey string, staleEntry *CacheEntry, hasStale bool) (*originResult, error) {
-	upstream := es.chooseUpstream(fallbackKey)
-	originURL := strings.TrimRight(upstream, "/") + r.URL.Path
-	if r.URL.RawQuery != "" {
-		originURL += "?" + r.URL.RawQuery
+// serveResultEntry answers r from the cached entry a fetch handed its
+// waiters. A disk entry comes without its body, which is opened again here;
+// if that version is gone by now, r goes to origin.
+func (es *EdgeServer) serveResultEntry(w http.ResponseWriter, r *http.Request, key string, entry *CacheEntry, cacheStatus string) {
+	if !entry.onDisk {
+		es.serveCachedEntry(w, r, key, entry, cacheStatus)
+		return
 	}
-	req, _ := http.NewRequestWithContext(r.Context(), r.Method, originURL, nil)
-	copyHeaders(req.Header, r.Header)
+	stored, body, found := es.disk.OpenStale(key)
+	if !found || !stored.createdAt.Equal(entry.createdAt) {
+		_ = body.Close()
+		es.serveNoCache(w, r)
+		return
+	}
+	es.serveDiskEntry(w, r, key, entry, body, cacheStatus)
+}
+
+// lookupStale finds an expired but retained copy of key in either tier. One
+// from disk has its body in the returned file, which the caller closes.
+func (es *EdgeServer) lookupStale(key string) (*CacheEntry, *diskBody, bool) {
+	if entry, found := es.cache.GetStale(key); found {
+		return entry, nil, true
+	}
+	return es.disk.OpenStale(key)
+}
 
+// revalidateInBackground refreshes a stale entry off the request path. Only one
+// refresh per key runs at a time; it shares the singleflight slot with
+// foreground misses so the two never race each other to origin.
+func (es *EdgeServer) revalidateInBackground(r *http.Request, baseKey, key string, stale *CacheEntry) {
+	if _, busy := es.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	bg := r.Clone(withoutClientEncoding(context.WithoutCancel(r.Context())))
+	bg.Header.Del("Range")
+	go func() {
+		defer es.refreshing.Delete(key)
+		_, _, _ = es.inflight.Do(key, func() (interface{}, error) {
+			return es.fetchFromOrigin(newDiscardResponseWriter(), bg, baseKey, key, stale, true)
+		})
+	}()
+}
+
+// promote copies a disk entry into memory when it is no larger than
+// promoteMax and the memory tier takes it, closing its body file. Larger
+// entries keep being served from disk.
+func (es *EdgeServer) promote(key string, entry *CacheEntry, body *diskBody) (*CacheEntry, *diskBody) {
+	size := body.Size()
+	if es.promoteMax <= 0 || size > es.promoteMax || !es.cache.Admits(size) {
+		return entry, body
+	}
+	data := make([]byte, size)
+	if _, err := body.ReadAt(data, 0); err != nil && err != io.EOF {
+		return entry, body
+	}
+	_ = body.Close()
+	entry.data, entry.onDisk = data, false
+	es.cache.Set(key, entry)
+	return entry, nil
+}
+
+// serveDiskEntry answers r from a disk entry: from its body file if it has
+// one, which it closes, or else from memory after promotion.
+func (es *EdgeServer) serveDiskEntry(w http.ResponseWriter, r *http.Request, key string, entry *CacheEntry, body *diskBody, cacheStatus string) {
+	if body == nil {
+		es.serveCachedEntry(w, r, key, entry, cacheStatus)
+		return
+	}
+	defer body.Close()
+	es.serveEntry(w, r, key, entry, body, cacheStatus)
+}
+
+// serveCachedEntry answers r from entry, stored under key.
+func (es *EdgeServer) serveCachedEntry(w http.ResponseWriter, r *http.Request, key string, entry *CacheEntry, cacheStatus string) {
+	es.serveEntry(w, r, key, entry, bytes.NewReader(entry.data), cacheStatus)
+}
+
+// serveEntry answers r from entry, whose body is read from body, encoding it
+// for the client when edge compression applies.
+func (es *EdgeServer) serveEntry(w http.ResponseWriter, r *http.Request, key string, entry *CacheEntry, body entryBody, cacheStatus string) {
+	compressible := es.compress.eligible(entry.statusCode, entry.header, body.Size())
+	// Multipart parts cannot say they are coded, so a request for several
+	// ranges gets them from the identity body.
+	if compressible && !strings.Contains(r.Header.Get("Range"), ",") {
+		if enc := es.compress.negotiate(r); enc != "" {
+			// A body that cannot be encoded is sent as it is.
+			if encoded, file, err := es.encodedEntry(key, entry, body, enc); err != nil {
+				log.Printf("compression: encoding %q as %s: %v", key, enc, err)
+			} else if file != nil {
+				defer file.Close()
+				entry, body = encoded, file
+			} else {
+				entry, body = encoded, bytes.NewReader(encoded.data)
+			}
+		}
+	}
+	copyHeaders(w.Header(), entry.header)
+	if compressible {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	w.Header().Set("X-Cache", cacheStatus)
+	setAge(w.Header(), entry, time.Now())
+	if notModified(r, entry.statusCode, entry.eTag, entry.lastModified) {
+		writeNotModified(w, entry.header)
+		return
+	}
+	es.writeResponseWithRange(w, r, entry.statusCode, entry.header, body)
+}
+
+func (es *EdgeServer) fetchFromOrigin(w http.ResponseWriter, r *http.Request, baseKey, fallbackKey string, staleEntry *CacheEntry, hasStale bool) (*originResult, error) {
+	req := es.originRequest(r, fallbackKey)
 	if hasStale {
 		if staleEntry.eTag != "" {
 			req.Header.Set("If-None-Match", staleEntry.eTag)
@@ -100,67 +357,213 @@ func (es *EdgeServer) fetchFromOrigin(r *http.Request, baseKey, fallbackKey stri
 		}
 	}
 
-	resp, err := es.client.Do(req)
+	requestTime := time.Now()
+	resp, err := es.doUpstream(req)
 	if err != nil {
+		if hasStale && es.canServeStaleOnError(staleEntry) {
+			return entryResult(staleEntry, "STALE-ERROR"), nil
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
+	responseTime := time.Now()
+
+	if resp.StatusCode >= http.StatusInternalServerError && hasStale && es.canServeStaleOnError(staleEntry) {
+		return entryResult(staleEntry, "STALE-ERROR"), nil
+	}
 
 	if resp.StatusCode == http.StatusNotModified && hasStale {
-		newTTL := getTTL(resp)
-		if newTTL > 0 {
-			staleEntry.expiresAt = time.Now().Add(newTTL)
+		initialAge := correctedInitialAge(resp.Header, requestTime, responseTime)
+		// The 304's fields replace the stored ones (RFC 9111 §4.3.4); what it
+		// leaves out, Cache-Control included, still applies.
+		merged := &http.Response{Header: revalidatedHeader(staleEntry.header, resp.Header)}
+		fresh := es.ttl.decide(staleEntry.statusCode, merged.Header, initialAge)
+		if fresh.store {
+			// staleEntry may be shared with other readers; revalidate a copy.
+			refreshed := staleEntry.derive()
+			refreshed.header = es.clientHeader(merged.Header)
+			refreshed.createdAt = responseTime
+			refreshed.initialAge = initialAge
+			fresh.apply(refreshed, responseTime)
 			if etag := resp.Header.Get("ETag"); etag != "" {
-				staleEntry.eTag = etag
+				refreshed.eTag = etag
 			}
 			if lm := resp.Header.Get("Last-Modified"); lm != "" {
-				staleEntry.lastModified = lm
+				refreshed.lastModified = lm
 			}
-			es.cache.Set(fallbackKey, staleEntry)
+			// The stored header may have had its tags stripped, so only a
+			// 304 that carries tags replaces them.
+			if tags := parseSurrogateKeys(resp.Header); len(tags) > 0 {
+				refreshed.tags = tags
+			}
+			refreshed.staleWhileRevalidate = getStaleWhileRevalidate(merged)
+			refreshed.staleIfError = getStaleIfError(merged)
+			refreshed.softPurged = false
+			refreshed.keepUntil = time.Time{}
+			// A copy from disk has its body there only.
+			if !refreshed.onDisk {
+				es.cache.Set(fallbackKey, refreshed)
+			}
+			es.disk.UpdateFreshness(fallbackKey, refreshed)
+			staleEntry = refreshed
 		}
-		return &originResult{
-			header:      staleEntry.header.Clone(),
-			statusCode:  staleEntry.statusCode,
-			body:        append([]byte(nil), staleEntry.data...),
-			cacheStatus: "REVALIDATED",
-		}, nil
+		return entryResult(staleEntry, "REVALIDATED"), nil
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	initialAge := correctedInitialAge(resp.Header, requestTime, responseTime)
+	fresh := es.ttl.decide(resp.StatusCode, resp.Header, initialAge)
+	cacheStatus := "BYPASS"
+	var (
+		storeKey string
+		fill     *cacheFill
+		share    *sharedBody
+	)
+	if fresh.store {
+		key, dropped, ok := es.cache.UpdateVary(baseKey, r, resp.Header)
+		es.dropVariants(key, dropped)
+		if ok {
+			storeKey = key
+			fill = es.newCacheFill(storeKey, resp.ContentLength)
+			cacheStatus = "MISS"
+		}
 	}
 
-	ttl := getTTL(resp)
-	cacheStatus := "BYPASS"
-	if ttl > 0 {
-		if es.cache.UpdateVary(baseKey, resp.Header) {
-			storeKey := es.cache.LookupKey(baseKey, r)
-			entry := &CacheEntry{
-				data:         body,
-				header:       resp.Header.Clone(),
-				statusCode:   resp.StatusCode,
-				createdAt:    time.Now(),
-				expiresAt:    time.Now().Add(ttl),
-				eTag:         resp.Header.Get("ETag"),
-				lastModified: resp.Header.Get("Last-Modified"),
+	// Waiters can only be served from the tiers if the body gets there.
+	var src io.Reader = resp.Body
+	if (storeKey == "" || es.disk == nil) && es.shareMax > 0 {
+		share = &sharedBody{max: es.shareMax}
+		src = io.TeeReader(resp.Body, share)
+	}
+
+	header := es.clientHeader(resp.Header)
+	copyHeaders(w.Header(), header)
+	w.Header().Set("X-Cache", cacheStatus)
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	var (
+		body   io.Writer = w
+		encode io.WriteCloser
+	)
+	sent := header
+	if es.compress.eligible(resp.StatusCode, header, resp.ContentLength) {
+		if enc := es.compress.negotiate(r); enc != "" {
+			// The cache gets the identity bytes; only this client's copy is
+			// encoded on the way through.
+			sent = encodedHeader(header, enc)
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Encoding", enc)
+			if etag := sent.Get("ETag"); etag != "" {
+				w.Header().Set("ETag", etag)
 			}
-			es.cache.Set(storeKey, entry)
-			es.disk.Set(storeKey, entry)
-			cacheStatus = "MISS"
+			encode = contentEncoders[enc](w)
+			body = encode
 		}
+		addVary(w.Header(), "Accept-Encoding")
 	}
 
-	return &originResult{
-		header:      resp.Header.Clone(),
-		statusCode:  resp.StatusCode,
-		body:        body,
+	// The client's own copy may still be current even though ours was not;
+	// it gets a 304 while the body goes only into the cache.
+	toClient := true
+	if notModified(r, resp.StatusCode, sent.Get("ETag"), sent.Get("Last-Modified")) {
+		writeNotModified(w, sent)
+		body, encode, toClient = newDiscardResponseWriter(), nil, false
+	} else {
+		w.WriteHeader(resp.StatusCode)
+	}
+
+	var (
+		sp         *spool
+		clientDone chan struct{}
+	)
+	if _, background := w.(*discardResponseWriter); toClient && !background {
+		sp, clientDone = streamToClient(body, encode)
+		body = sp
+	}
+	err = streamBody(body, src, fill)
+	if sp != nil {
+		sp.close(err)
+	} else if err == nil && encode != nil {
+		_ = encode.Close()
+	}
+	if err != nil {
+		fill.abort()
+		return &originResult{streamed: true, truncated: toClient, clientDone: clientDone}, err
+	}
+
+	var filledAt time.Time
+	if fill != nil {
+		entry := &CacheEntry{
+			header:       header,
+			statusCode:   resp.StatusCode,
+			createdAt:    responseTime,
+			initialAge:   initialAge,
+			eTag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			tags:         parseSurrogateKeys(resp.Header),
+
+			staleWhileRevalidate: getStaleWhileRevalidate(resp),
+			staleIfError:         getStaleIfError(resp),
+		}
+		fresh.apply(entry, entry.createdAt)
+		fill.commit(entry)
+		filledAt = entry.createdAt
+	}
+
+	res := &originResult{
 		cacheStatus: cacheStatus,
-	}, nil
+		streamed:    true,
+		storeKey:    storeKey,
+		filledAt:    filledAt,
+		clientDone:  clientDone,
+	}
+	if data, ok := share.bytes(); ok {
+		res.header, res.statusCode, res.body, res.shared = header, resp.StatusCode, data, true
+	}
+	return res, nil
+}
+
+// streamToClient writes a body to the leading request's client, through
+// encode if it is set, from the spool it returns, and closes done when it is
+// through. A truncated body does not get a coding trailer, so the client
+// cannot take it for complete.
+func streamToClient(w io.Writer, encode io.WriteCloser) (sp *spool, done chan struct{}) {
+	sp, done = newSpool(), make(chan struct{})
+	go func() {
+		defer close(done)
+		if sp.writeTo(w) == nil && encode != nil {
+			_ = encode.Close()
+		}
+	}()
+	return sp, done
+}
+
+// originRequest builds the upstream request that fills key for r: the
+// client's headers without its validators and, under the ignore policies,
+// without its cache directives. The fetch fills the cache for every waiter,
+// so it outlives the client that triggered it; the upstream timeouts still
+// bound it.
+func (es *EdgeServer) originRequest(r *http.Request, key string) *http.Request {
+	upstream := es.chooseUpstream(key)
+	originURL := strings.TrimRight(upstream, "/") + r.URL.Path
+	if r.URL.RawQuery != "" {
+		originURL += "?" + r.URL.RawQuery
+	}
+	req, _ := http.NewRequestWithContext(context.WithoutCancel(r.Context()), r.Method, originURL, nil)
+	copyHeaders(req.Header, r.Header)
+	for _, h := range clientValidators {
+		req.Header.Del(h)
+	}
+	if es.clientCache == ClientCacheIgnore || es.clientCache == ClientCacheIgnoreReload {
+		// Directives the edge disregards are not passed on for the origin
+		// (or a shield) to act on either.
+		req.Header.Del("Cache-Control")
+		req.Header.Del("Pragma")
+	}
+	return req
 }
 
 func (es *EdgeServer) serveNoCache(w http.ResponseWriter, r *http.Request) {
-	baseKey := cacheBaseKey(r)
+	baseKey := es.keys.baseKey(r)
 	upstream := es.chooseUpstream(baseKey)
 	originURL := strings.TrimRight(upstream, "/") + r.URL.Path
 	if r.URL.RawQuery != "" {
@@ -170,16 +573,16 @@ func (es *EdgeServer) serveNoCache(w http.ResponseWriter, r *http.Request) {
 	req, _ := http.NewRequestWithContext(r.Context(), r.Method, originURL, r.Body)
 	copyHeaders(req.Header, r.Header)
 
-	resp, err := es.client.Do(req)
+	resp, err := es.doUpstream(req)
 	if err != nil {
-		http.Error(w, "Origin fetch failed", http.StatusBadGateway)
+		if !es.serveStaleOnError(w, r) {
+			http.Error(w, "Origin fetch failed", http.StatusBadGateway)
+		}
 		return
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		http.Error(w, "Failed to read origin response", http.StatusInternalServerError)
+	if resp.StatusCode >= http.StatusInternalServerError && es.serveStaleOnError(w, r) {
 		return
 	}
 
@@ -188,8 +591,184 @@ func (es *EdgeServer) serveNoCache(w http.ResponseWriter, r *http.Request) {
 	} else {
 		w.Header().Set("X-Cache", "BYPASS")
 	}
-	copyHeaders(w.Header(), resp.Header)
-	writeResponseWithRange(w, r, resp.StatusCode, resp.Header, body)
+	copyHeaders(w.Header(), es.clientHeader(resp.Header))
+
+	// An origin that ignored Range sent the full body; slice it here.
+	if r.Header.Get("Range") != "" && resp.StatusCode == http.StatusOK {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, "Failed to read origin response", http.StatusInternalServerError)
+			return
+		}
+		es.writeResponseWithRange(w, r, resp.StatusCode, resp.Header, bytes.NewReader(body))
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(resp.StatusCode)
+	if err := streamBody(w, resp.Body, nil); err != nil {
+		// Don't let a cut-off body end like a complete one.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// doUpstream sends req upstream. Connecting and waiting for the response
+// headers are bounded by the client; the body may take as long as it keeps
+// arriving, but is given up once a read stalls for upstreamIdle. A slow
+// client does not count: only time spent waiting on upstream does.
+func (es *EdgeServer) doUpstream(req *http.Request) (*http.Response, error) {
+	if es.upstreamIdle <= 0 {
+		return es.client.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err := es.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	timer := time.AfterFunc(es.upstreamIdle, cancel)
+	timer.Stop()
+	resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, timer: timer, idle: es.upstreamIdle, cancel: cancel}
+	return resp, nil
+}
+
+// idleTimeoutBody cancels its request when a single Read waits longer than
+// idle.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	idle   time.Duration
+	cancel context.CancelFunc
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.idle)
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// canServeStaleOnError reports whether an expired entry may be used in place
+// of an origin error, per stale-if-error or the always-online window.
+func (es *EdgeServer) canServeStaleOnError(entry *CacheEntry) bool {
+	if entry.mustRevalidate {
+		return false
+	}
+	now := time.Now()
+	if entry.softPurged && now.Before(entry.keepUntil) {
+		return true
+	}
+	return now.Before(entry.expiresAt.Add(max(entry.staleIfError, es.alwaysOnline)))
+}
+
+// keptOn304 are the stored fields a 304 does not replace: they describe the
+// stored body or the hop it came over, not the representation.
+var keptOn304 = map[string]bool{
+	"Content-Length":    true,
+	"Content-Encoding":  true,
+	"Content-Range":     true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+}
+
+// revalidatedHeader is the stored header updated with the fields of a 304
+// response. The refreshed entry keeps it, and its freshness is computed from
+// it.
+func revalidatedHeader(stored, notModified http.Header) http.Header {
+	h := stored.Clone()
+	h.Del("Age")
+	for k, v := range notModified {
+		if !keptOn304[k] {
+			h[k] = v
+		}
+	}
+	return h
+}
+
+// setAge replaces the origin's Age with the entry's current age, so clients
+// and downstream caches account for the time it spent here and upstream. Date
+// stays the origin's, as it marks when the response was generated.
+func setAge(h http.Header, entry *CacheEntry, now time.Time) {
+	h.Set("Age", strconv.FormatInt(int64(entry.currentAge(now)/time.Second), 10))
+}
+
+// derivedKeyParts are what the copies stored alongside an entry add to its
+// key: encoded copies (compress.go) and slices (slice.go).
+var derivedKeyParts = []string{"|ce=", "|slice="}
+
+// dropVariants removes the variants UpdateVary dropped, other than key, from
+// the disk tier, and the copies derived from them from both tiers.
+func (es *EdgeServer) dropVariants(key string, dropped []string) {
+	var prefixes []string
+	for _, k := range dropped {
+		if k == key {
+			continue
+		}
+		es.disk.Delete(k)
+		for _, part := range derivedKeyParts {
+			prefixes = append(prefixes, k+part)
+		}
+	}
+	if len(prefixes) == 0 {
+		return
+	}
+	match := func(k string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				return true
+			}
+		}
+		return false
+	}
+	es.cache.DeleteMatching(match)
+	es.disk.DeleteMatching(match)
+}
+
+// entryResult wraps a cached entry for the singleflight waiters. The body and
+// header are shared, not copied; nobody writes to them.
+func entryResult(entry *CacheEntry, cacheStatus string) *originResult {
+	return &originResult{
+		header:      entry.header,
+		statusCode:  entry.statusCode,
+		body:        entry.data,
+		cacheStatus: cacheStatus,
+		entry:       entry,
+	}
+}
+
+// serveStaleOnError answers an uncached request from a stale copy when the
+// origin failed. Only GET and HEAD have anything cached to fall back on.
+func (es *EdgeServer) serveStaleOnError(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	key := es.cache.LookupKey(es.keys.baseKey(r), r)
+	entry, body, found := es.lookupStale(key)
+	if !found || !es.canServeStaleOnError(entry) {
+		_ = body.Close()
+		return false
+	}
+	es.serveDiskEntry(w, r, key, entry, body, "STALE-ERROR")
+	return true
+}
+
+// clientHeader returns the origin header as it should reach clients and the
+// cache. Tag headers are internal unless the operator chose to expose them,
+// e.g. on a shield whose edges need them for their own tag index.
+func (es *EdgeServer) clientHeader(h http.Header) http.Header {
+	out := h.Clone()
+	if !es.exposeTags {
+		out.Del("Surrogate-Key")
+		out.Del("Cache-Tag")
+	}
+	return out
 }
 
 func (es *EdgeServer) chooseUpstream(cacheKey string) string {
@@ -207,6 +786,19 @@ func (es *EdgeServer) chooseUpstream(cacheKey string) string {
 	return es.origin
 }
 
+// discardResponseWriter swallows the response of a background fetch.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func newDiscardResponseWriter() *discardResponseWriter {
+	return &discardResponseWriter{header: make(http.Header)}
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+
 func copyHeaders(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestRevalidateEmptyBody checks that an empty response kept in memory for
+// revalidation is refreshed in place on a 304, rather than taken for a disk
+// entry whose body has to be opened again.
+func TestRevalidateEmptyBody(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"empty"`)
+		if r.Header.Get("If-None-Match") == `"empty"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer origin.Close()
+
+	es := &EdgeServer{
+		origin:  origin.URL,
+		origins: []string{origin.URL},
+		cache:   NewCache(time.Minute, 1<<20),
+		client:  origin.Client(),
+		ttl:     &ttlPolicy{validationWindow: time.Hour},
+	}
+	want := []string{"MISS", "REVALIDATED", "REVALIDATED"}
+	for i, status := range want {
+		w := httptest.NewRecorder()
+		es.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/empty", nil))
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Fatalf("request %d: status %d, %d body bytes", i, w.Code, w.Body.Len())
+		}
+		if got := w.Header().Get("X-Cache"); got != status {
+			t.Errorf("request %d: X-Cache %q, want %q", i, got, status)
+		}
+		if got := hits.Load(); got != int32(i+1) {
+			t.Fatalf("request %d: %d origin requests, want %d", i, got, i+1)
+		}
+	}
+}
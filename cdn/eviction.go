@@ -0,0 +1,185 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+)
+
+// evictor tracks the access history of one Cache and decides which key goes
+// next when the cache is over its byte budget. Every method is called with
+// the cache lock held and must run in O(1) (amortised).
+type evictor interface {
+	// add records a store of key. Storing a key that is already tracked
+	// counts as an access and updates its size.
+	add(key string, size int64)
+	// access records a hit on key.
+	access(key string)
+	// remove forgets key after a delete, purge or expiry.
+	remove(key string)
+	// victim picks the next key to evict and stops tracking it. ok is false
+	// when nothing is left.
+	victim() (key string, ok bool)
+}
+
+// newEvictor builds the evictor for policy. capacity is the byte budget it
+// works within; policies that size internal segments need it.
+func newEvictor(policy EvictionPolicy, capacity int64) evictor {
+	switch policy {
+	case EvictionLFU:
+		return newLFUEvictor()
+	case EvictionWTinyLFU:
+		return newTinyLFUEvictor(capacity)
+	case EvictionS3FIFO:
+		return newS3FIFOEvictor()
+	case EvictionARC:
+		return newARCEvictor()
+	default:
+		return newLRUEvictor()
+	}
+}
+
+// normalizeEvictionPolicy maps the accepted spellings of each policy onto its
+// canonical name. Anything unrecognised is LRU.
+func normalizeEvictionPolicy(policy EvictionPolicy) EvictionPolicy {
+	name := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(string(policy))))
+	switch name {
+	case "lfu":
+		return EvictionLFU
+	case "wtinylfu", "tinylfu":
+		return EvictionWTinyLFU
+	case "s3fifo":
+		return EvictionS3FIFO
+	case "arc":
+		return EvictionARC
+	default:
+		return EvictionLRU
+	}
+}
+
+// lruEvictor evicts the least recently used key.
+type lruEvictor struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (e *lruEvictor) add(key string, _ int64) {
+	if elem, ok := e.elems[key]; ok {
+		e.order.MoveToFront(elem)
+		return
+	}
+	e.elems[key] = e.order.PushFront(key)
+}
+
+func (e *lruEvictor) access(key string) {
+	if elem, ok := e.elems[key]; ok {
+		e.order.MoveToFront(elem)
+	}
+}
+
+func (e *lruEvictor) remove(key string) {
+	if elem, ok := e.elems[key]; ok {
+		e.order.Remove(elem)
+		delete(e.elems, key)
+	}
+}
+
+func (e *lruEvictor) victim() (string, bool) {
+	back := e.order.Back()
+	if back == nil {
+		return "", false
+	}
+	key := back.Value.(string)
+	e.order.Remove(back)
+	delete(e.elems, key)
+	return key, true
+}
+
+// lfuEvictor is the constant-time LFU scheme: keys live in per-frequency
+// buckets, and the buckets form a list ordered by frequency. Ties within a
+// bucket are broken by recency, so the victim is the least recently used key
+// of the lowest frequency.
+type lfuEvictor struct {
+	buckets *list.List // of *lfuBucket, ascending freq
+	nodes   map[string]*lfuNode
+}
+
+type lfuBucket struct {
+	freq  uint64
+	items *list.List // of *lfuNode, most recent first
+}
+
+type lfuNode struct {
+	key    string
+	bucket *list.Element
+	elem   *list.Element
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{
+		buckets: list.New(),
+		nodes:   make(map[string]*lfuNode),
+	}
+}
+
+func (e *lfuEvictor) add(key string, _ int64) {
+	if _, ok := e.nodes[key]; ok {
+		e.access(key)
+		return
+	}
+	front := e.buckets.Front()
+	if front == nil || front.Value.(*lfuBucket).freq != 1 {
+		front = e.buckets.PushFront(&lfuBucket{freq: 1, items: list.New()})
+	}
+	node := &lfuNode{key: key, bucket: front}
+	node.elem = front.Value.(*lfuBucket).items.PushFront(node)
+	e.nodes[key] = node
+}
+
+func (e *lfuEvictor) access(key string) {
+	node, ok := e.nodes[key]
+	if !ok {
+		return
+	}
+	cur := node.bucket
+	freq := cur.Value.(*lfuBucket).freq
+	next := cur.Next()
+	if next == nil || next.Value.(*lfuBucket).freq != freq+1 {
+		next = e.buckets.InsertAfter(&lfuBucket{freq: freq + 1, items: list.New()}, cur)
+	}
+	e.unlink(node)
+	node.bucket = next
+	node.elem = next.Value.(*lfuBucket).items.PushFront(node)
+}
+
+func (e *lfuEvictor) remove(key string) {
+	if node, ok := e.nodes[key]; ok {
+		e.unlink(node)
+		delete(e.nodes, key)
+	}
+}
+
+func (e *lfuEvictor) victim() (string, bool) {
+	front := e.buckets.Front()
+	if front == nil {
+		return "", false
+	}
+	node := front.Value.(*lfuBucket).items.Back().Value.(*lfuNode)
+	e.remove(node.key)
+	return node.key, true
+}
+
+// unlink takes node out of its bucket and drops the bucket once it is empty.
+func (e *lfuEvictor) unlink(node *lfuNode) {
+	bucket := node.bucket.Value.(*lfuBucket)
+	bucket.items.Remove(node.elem)
+	if bucket.items.Len() == 0 {
+		e.buckets.Remove(node.bucket)
+	}
+}
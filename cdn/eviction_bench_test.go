@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// benchTraces selects the access traces BenchmarkEviction replays, so
+// recorded production traces can be compared without checking them in:
+//
+//	go test -run '^$' -bench Eviction -traces '/data/traces/*.trace'
+var benchTraces = flag.String("traces", "testdata/*.trace", "glob of access traces for BenchmarkEviction")
+
+// benchCapacities are the cache sizes compared, as percentages of a trace's
+// working set.
+var benchCapacities = []int64{1, 5, 10, 25}
+
+// benchPolicies are the eviction policies compared by BenchmarkEviction.
+var benchPolicies = []EvictionPolicy{EvictionLRU, EvictionLFU, EvictionWTinyLFU, EvictionS3FIFO, EvictionARC}
+
+type traceRequest struct {
+	key  string
+	size int64
+}
+
+type benchResult struct {
+	requests  int
+	hits      int
+	bytes     int64
+	byteHits  int64
+	evictions int
+}
+
+// BenchmarkEviction replays each trace against every eviction policy and
+// reports object and byte hit ratios next to the time per replay.
+//
+// A trace has one request per line: a key and, optionally, the object size
+// in bytes (default 1). Blank lines and lines starting with # are skipped.
+func BenchmarkEviction(b *testing.B) {
+	paths, err := filepath.Glob(*benchTraces)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(paths) == 0 {
+		b.Skipf("no traces match %q", *benchTraces)
+	}
+	for _, path := range paths {
+		trace, workingSet, err := loadTrace(path)
+		if err != nil {
+			b.Fatalf("%s: %v", path, err)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		for _, pct := range benchCapacities {
+			capacity := max(workingSet*pct/100, 1)
+			for _, policy := range benchPolicies {
+				b.Run(fmt.Sprintf("%s/%d%%/%s", name, pct, policy), func(b *testing.B) {
+					var res benchResult
+					for b.Loop() {
+						res = simulateEviction(policy, trace, capacity)
+					}
+					b.ReportMetric(ratio(int64(res.hits), int64(res.requests)), "hit-ratio")
+					b.ReportMetric(ratio(res.byteHits, res.bytes), "byte-hit-ratio")
+					b.ReportMetric(float64(res.evictions), "evictions")
+				})
+			}
+		}
+	}
+}
+
+// simulateEviction drives an evictor the way Cache does, with the same byte
+// accounting, but without storing any bodies.
+func simulateEviction(policy EvictionPolicy, trace []traceRequest, capacity int64) benchResult {
+	ev := newEvictor(policy, capacity)
+	sizes := make(map[string]int64)
+	var (
+		res  benchResult
+		used int64
+	)
+	for _, req := range trace {
+		res.requests++
+		res.bytes += req.size
+		if _, ok := sizes[req.key]; ok {
+			ev.access(req.key)
+			res.hits++
+			res.byteHits += req.size
+			continue
+		}
+		if req.size > capacity {
+			continue
+		}
+		sizes[req.key] = req.size
+		used += req.size
+		ev.add(req.key, req.size)
+		for used > capacity {
+			key, ok := ev.victim()
+			if !ok {
+				break
+			}
+			used -= sizes[key]
+			delete(sizes, key)
+			res.evictions++
+		}
+	}
+	return res
+}
+
+func loadTrace(path string) ([]traceRequest, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	return parseTrace(f)
+}
+
+func parseTrace(r io.Reader) ([]traceRequest, int64, error) {
+	var (
+		trace      []traceRequest
+		workingSet int64
+	)
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		req := traceRequest{key: fields[0], size: 1}
+		if len(fields) > 1 {
+			size, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil || size < 0 {
+				return nil, 0, fmt.Errorf("line %d: invalid size %q", line, fields[1])
+			}
+			req.size = size
+		}
+		if !seen[req.key] {
+			seen[req.key] = true
+			workingSet += req.size
+		}
+		trace = append(trace, req)
+	}
+	return trace, workingSet, sc.Err()
+}
+
+func ratio(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
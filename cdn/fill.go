@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// spoolMemBytes is how much of a body a spool holds in memory before it
+// spills the rest to a temporary file.
+const spoolMemBytes = 1 << 20
+
+// errSpoolClosed is what writes to a spool get once its reader is done.
+var errSpoolClosed = errors.New("spool reader is gone")
+
+// cacheFill collects an origin body for the memory and disk tiers while it is
+// being streamed to the client. The memory copy is dropped as soon as the
+// object grows past the cache's per-object limit.
+type cacheFill struct {
+	key   string
+	cache *Cache
+	mem   bytes.Buffer
+	memOK bool
+	disk  *diskWriter
+}
+
+func (es *EdgeServer) newCacheFill(key string, contentLength int64) *cacheFill {
+	f := &cacheFill{
+		key:   key,
+		cache: es.cache,
+		memOK: contentLength < 0 || es.cache.Admits(contentLength),
+	}
+	if f.memOK && contentLength > 0 {
+		f.mem.Grow(int(contentLength))
+	}
+	if dw, err := es.disk.NewWriter(key); err == nil {
+		f.disk = dw
+	}
+	return f
+}
+
+func (f *cacheFill) Write(p []byte) (int, error) {
+	if f.memOK {
+		if f.cache.Admits(int64(f.mem.Len() + len(p))) {
+			f.mem.Write(p)
+		} else {
+			f.memOK = false
+			f.mem = bytes.Buffer{}
+		}
+	}
+	if f.disk != nil {
+		if _, err := f.disk.Write(p); err != nil {
+			f.disk.Abort()
+			f.disk = nil
+		}
+	}
+	return len(p), nil
+}
+
+func (f *cacheFill) commit(entry *CacheEntry) {
+	if f == nil {
+		return
+	}
+	if f.memOK {
+		entry.data = f.mem.Bytes()
+		f.cache.Set(f.key, entry)
+	}
+	if f.disk != nil {
+		_ = f.disk.Commit(entry)
+	}
+}
+
+func (f *cacheFill) abort() {
+	if f == nil {
+		return
+	}
+	f.mem = bytes.Buffer{}
+	f.disk.Abort()
+}
+
+// sharedBody keeps a copy of a body the tiers will not hold, up to max bytes,
+// for the requests that waited on its fetch. Past max it gives up.
+type sharedBody struct {
+	buf  bytes.Buffer
+	max  int64
+	over bool
+}
+
+func (s *sharedBody) Write(p []byte) (int, error) {
+	switch {
+	case s.over:
+	case int64(s.buf.Len()+len(p)) > s.max:
+		s.over = true
+		s.buf = bytes.Buffer{}
+	default:
+		s.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// bytes returns the whole body, if it was kept.
+func (s *sharedBody) bytes() ([]byte, bool) {
+	if s == nil || s.over {
+		return nil, false
+	}
+	return s.buf.Bytes(), true
+}
+
+// streamBody copies an origin body to the client and, if fill is set, into the
+// cache tiers. A client that goes away does not stop the fill; only a failed
+// origin read does, and that error is returned so the fill can be discarded.
+func streamBody(w io.Writer, body io.Reader, fill *cacheFill) error {
+	buf := make([]byte, 32*1024)
+	var clientErr error
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if fill != nil {
+				_, _ = fill.Write(buf[:n])
+			}
+			if clientErr == nil {
+				_, clientErr = w.Write(buf[:n])
+				if clientErr != nil && fill == nil {
+					return clientErr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// spool sits between an origin fetch and the client of the request that
+// leads it, so the fetch, and with it the requests waiting on it, goes at
+// origin's pace rather than that client's. Writes never wait for the
+// reader; what it has not read yet is kept in memory up to spoolMemBytes
+// and in a temporary file past that.
+type spool struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	// mem holds the chunks not read yet, memLen their size. Once file is
+	// set every later write goes there, after what is left in mem.
+	mem    [][]byte
+	memLen int
+	file   *os.File
+	// wOff and rOff are how far the file has been written and read.
+	wOff, rOff int64
+	// done is set when the body is complete, err if it broke off. gone is
+	// set once the reader has stopped, with what later writes are refused.
+	done bool
+	err  error
+	gone error
+}
+
+func newSpool() *spool {
+	s := &spool{}
+	s.cond.L = &s.mu
+	return s
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gone != nil {
+		return 0, s.gone
+	}
+	if s.file == nil && s.memLen+len(p) <= spoolMemBytes {
+		s.mem = append(s.mem, bytes.Clone(p))
+		s.memLen += len(p)
+		s.cond.Signal()
+		return len(p), nil
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp("", "edge-spool-*")
+		if err != nil {
+			s.failLocked(err)
+			return 0, err
+		}
+		_ = os.Remove(f.Name())
+		s.file = f
+	}
+	if _, err := s.file.WriteAt(p, s.wOff); err != nil {
+		s.failLocked(err)
+		return 0, err
+	}
+	s.wOff += int64(len(p))
+	s.cond.Signal()
+	return len(p), nil
+}
+
+// failLocked ends the body with err for the reader and refuses the rest.
+func (s *spool) failLocked(err error) {
+	s.done, s.err, s.gone = true, err, err
+	s.cond.Signal()
+}
+
+// close marks the body complete, or cut off by err.
+func (s *spool) close(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.done {
+		s.done, s.err = true, err
+	}
+	s.cond.Signal()
+}
+
+// writeTo copies the body to w as it arrives. It returns nil once all of a
+// complete body is written, the error the body broke off with, or w's
+// error.
+func (s *spool) writeTo(w io.Writer) (err error) {
+	defer func() {
+		s.mu.Lock()
+		if s.gone == nil {
+			s.gone = errSpoolClosed
+		}
+		s.mem, s.memLen = nil, 0
+		if s.file != nil {
+			_ = s.file.Close()
+		}
+		s.mu.Unlock()
+	}()
+	buf := make([]byte, 32*1024)
+	for {
+		s.mu.Lock()
+		for len(s.mem) == 0 && s.rOff == s.wOff && !s.done {
+			s.cond.Wait()
+		}
+		var chunk []byte
+		switch {
+		case len(s.mem) > 0:
+			chunk = s.mem[0]
+			s.mem[0] = nil
+			s.mem = s.mem[1:]
+			s.memLen -= len(chunk)
+			s.mu.Unlock()
+		case s.rOff < s.wOff:
+			chunk = buf[:min(int64(len(buf)), s.wOff-s.rOff)]
+			f, off := s.file, s.rOff
+			s.mu.Unlock()
+			// That part of the file is written and only the reader moves
+			// rOff, so it is read without the lock.
+			if _, err := f.ReadAt(chunk, off); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			s.rOff += int64(len(chunk))
+			s.mu.Unlock()
+		default:
+			err := s.err
+			s.mu.Unlock()
+			return err
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+}
@@ -3,5 +3,7 @@ module github.com/broisnischal/go-cdn/cdn
 go 1.25.7
 
 require (
+	github.com/andybalholm/brotli v1.2.6
+	github.com/klauspost/compress v1.20.1
 	golang.org/x/sync v0.19.0
 )
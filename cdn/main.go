@@ -1,136 +1,320 @@
 package main
 
 import (
-	"container/list"
 	"crypto/tls"
+	"hash/maphash"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// CacheEntry is a stored response. Once an entry has been handed to Cache.Set
+// it is immutable: its body, header and tags are shared with every reader
+// without copying. Changes go through derive, which makes a shallow copy that
+// can be modified and stored in place of the original.
 type CacheEntry struct {
 	data         []byte
 	header       http.Header
 	statusCode   int
-	createdAt    time.Time
+	createdAt    time.Time // when the response was received
 	expiresAt    time.Time
 	eTag         string
 	lastModified string
 	sizeBytes    int64
+	// onDisk marks an entry handed out by DiskCache.Open or OpenStale: its
+	// body is in the file returned with it, not in data.
+	onDisk bool
+	// tags are the Surrogate-Key / Cache-Tag groups the entry belongs to.
+	tags []string
+	// initialAge is how old the response was when it arrived, counting
+	// time spent in upstream caches and in transit.
+	initialAge time.Duration
+
+	// staleWhileRevalidate is the grace window after expiresAt during which
+	// the entry may be served while a background refresh runs.
+	staleWhileRevalidate time.Duration
+	// staleIfError is how long after expiresAt the entry may stand in for a
+	// failing origin.
+	staleIfError time.Duration
+
+	// softPurged marks an entry invalidated by a soft purge. It must be
+	// revalidated before reuse but stays available as an error fallback
+	// until keepUntil.
+	softPurged bool
+	keepUntil  time.Time
+
+	// mustRevalidate forbids serving the entry once it is stale, whatever
+	// its stale-* windows say; it is only kept for its validators, for
+	// validationWindow after expiresAt.
+	mustRevalidate   bool
+	validationWindow time.Duration
 }
 
+// retainUntil is how long an expired entry is kept around for stale serving
+// or revalidation. alwaysOnline is the operator's minimum retention for
+// serving through origin outages.
+func (e *CacheEntry) retainUntil(alwaysOnline time.Duration) time.Time {
+	until := e.expiresAt.Add(e.validationWindow)
+	if !e.mustRevalidate {
+		until = e.expiresAt.Add(max(e.staleWhileRevalidate, e.staleIfError, alwaysOnline, e.validationWindow))
+	}
+	if e.keepUntil.After(until) {
+		return e.keepUntil
+	}
+	return until
+}
+
+// currentAge is the entry's RFC 9111 §4.2.3 age at now.
+func (e *CacheEntry) currentAge(now time.Time) time.Duration {
+	return e.initialAge + max(now.Sub(e.createdAt), 0)
+}
+
+// derive returns a shallow copy of e for copy-on-write updates. The body,
+// header and tags stay shared and must not be modified through the copy.
+func (e *CacheEntry) derive() *CacheEntry {
+	d := *e
+	return &d
+}
+
+// softPurge expires the entry now while keeping it, body and validators
+// included, for as long as it would have been retained anyway. It modifies e,
+// so it is only called on an entry that has not been published yet.
+func (e *CacheEntry) softPurge(alwaysOnline time.Duration, now time.Time) {
+	e.keepUntil = e.retainUntil(alwaysOnline)
+	e.softPurged = true
+	if e.expiresAt.After(now) {
+		e.expiresAt = now.Add(-time.Second)
+	}
+}
+
+// Cache is the in-memory tier. Keys are spread over independently locked
+// shards so concurrent requests for different objects do not serialize on a
+// single mutex; each shard has its own eviction state and an equal share of
+// maxBytes.
 type Cache struct {
+	shards     []*cacheShard
+	seed       maphash.Seed
+	ttl        time.Duration
+	maxBytes   int64
+	shardBytes int64
+
+	maxObject   atomic.Int64
+	staleFloor  atomic.Int64 // time.Duration
+	maxVariants atomic.Int64
+}
+
+type cacheShard struct {
 	mu          sync.RWMutex
-	store       map[string]*list.Element
-	lru         *list.List
-	ttl         time.Duration
+	store       map[string]*cacheItem
+	evict       evictor
 	maxBytes    int64
 	currentSize int64
-	varyByBase  map[string][]string
+	varyByBase  map[string]*varyState
+	tagIndex    map[string]map[string]struct{}
 	policy      EvictionPolicy
 }
 
 type EvictionPolicy string
 
 const (
-	EvictionLRU EvictionPolicy = "lru"
-	EvictionLFU EvictionPolicy = "lfu"
+	EvictionLRU      EvictionPolicy = "lru"
+	EvictionLFU      EvictionPolicy = "lfu"
+	EvictionWTinyLFU EvictionPolicy = "wtinylfu"
+	EvictionS3FIFO   EvictionPolicy = "s3fifo"
+	EvictionARC      EvictionPolicy = "arc"
 )
 
+// defaultCacheShards is the shard count used by NewCache.
+const defaultCacheShards = 16
+
+// varyState is what the cache knows about one URL's variants: the request
+// headers its responses Vary on and the keys stored for it, oldest first.
+type varyState struct {
+	headers  []string
+	variants []string
+}
+
 type cacheItem struct {
-	key        string
-	entry      *CacheEntry
-	hits       uint64
-	lastAccess time.Time
+	key   string
+	entry *CacheEntry
 }
 
 func NewCache(ttl time.Duration, maxBytes int64) *Cache {
-	return &Cache{
-		store:      make(map[string]*list.Element),
-		lru:        list.New(),
-		ttl:        ttl,
-		maxBytes:   maxBytes,
-		varyByBase: make(map[string][]string),
-		policy:     EvictionLRU,
+	return NewShardedCache(ttl, maxBytes, defaultCacheShards)
+}
+
+// NewShardedCache creates a cache split into n shards. A positive maxBytes is
+// divided evenly between them, so no single object larger than maxBytes/n can
+// stay resident.
+func NewShardedCache(ttl time.Duration, maxBytes int64, n int) *Cache {
+	if n <= 0 {
+		n = 1
+	}
+	c := &Cache{
+		shards:   make([]*cacheShard, n),
+		seed:     maphash.MakeSeed(),
+		ttl:      ttl,
+		maxBytes: maxBytes,
+	}
+	shardBytes := maxBytes
+	if maxBytes > 0 {
+		shardBytes = (maxBytes + int64(n) - 1) / int64(n)
+	}
+	c.shardBytes = shardBytes
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{
+			store:      make(map[string]*cacheItem),
+			evict:      newEvictor(EvictionLRU, shardBytes),
+			maxBytes:   shardBytes,
+			varyByBase: make(map[string]*varyState),
+			tagIndex:   make(map[string]map[string]struct{}),
+			policy:     EvictionLRU,
+		}
 	}
+	return c
 }
 
+func (c *Cache) shardFor(key string) *cacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+// SetEvictionPolicy switches the eviction policy. Unknown names fall back to
+// LRU. Entries already stored are handed to the new policy as fresh inserts.
 func (c *Cache) SetEvictionPolicy(policy EvictionPolicy) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if policy != EvictionLFU {
-		c.policy = EvictionLRU
-		return
+	policy = normalizeEvictionPolicy(policy)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.policy = policy
+		s.evict = newEvictor(policy, s.maxBytes)
+		for key, item := range s.store {
+			s.evict.add(key, item.entry.sizeBytes)
+		}
+		s.mu.Unlock()
 	}
-	c.policy = EvictionLFU
+}
+
+// SetMaxObjectBytes limits the size of a single entry kept in memory. Larger
+// objects are left to the disk tier. Zero or less disables the limit.
+func (c *Cache) SetMaxObjectBytes(n int64) {
+	c.maxObject.Store(n)
+}
+
+// SetAlwaysOnline keeps expired entries for at least d so they can be served
+// while the origin is down.
+func (c *Cache) SetAlwaysOnline(d time.Duration) {
+	c.staleFloor.Store(int64(d))
+}
+
+func (c *Cache) alwaysOnline() time.Duration {
+	return time.Duration(c.staleFloor.Load())
+}
+
+// Admits reports whether an object of size bytes may be stored in memory.
+// Nothing larger than a shard's budget is admitted, whatever the limit.
+func (c *Cache) Admits(size int64) bool {
+	if c.shardBytes > 0 && size > c.shardBytes {
+		return false
+	}
+	maxObject := c.maxObject.Load()
+	return maxObject <= 0 || size <= maxObject
+}
+
+// SizeBytes is the estimated size of everything held, across all shards.
+func (c *Cache) SizeBytes() int64 {
+	var total int64
+	for _, s := range c.shards {
+		s.mu.RLock()
+		total += s.currentSize
+		s.mu.RUnlock()
+	}
+	return total
+}
+
+// Len is the number of entries held, across all shards.
+func (c *Cache) Len() int {
+	var total int
+	for _, s := range c.shards {
+		s.mu.RLock()
+		total += len(s.store)
+		s.mu.RUnlock()
+	}
+	return total
 }
 
 func (c *Cache) Get(key string) (*CacheEntry, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	elem, ok := c.store[key]
+	item, ok := s.store[key]
 	if !ok {
 		return nil, false
 	}
-	item := elem.Value.(*cacheItem)
-	if item.entry.expiresAt.Before(time.Now()) {
-		c.removeElement(elem)
+	now := time.Now()
+	if item.entry.expiresAt.Before(now) {
+		if item.entry.retainUntil(c.alwaysOnline()).Before(now) {
+			s.removeItem(item)
+		}
 		return nil, false
 	}
 
-	item.hits++
-	item.lastAccess = time.Now()
-	c.lru.MoveToFront(elem)
-	return cloneEntry(item.entry), true
+	s.evict.access(key)
+	return item.entry, true
 }
 
 func (c *Cache) GetStale(key string) (*CacheEntry, bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	elem, ok := c.store[key]
+	item, ok := s.store[key]
 	if !ok {
 		return nil, false
 	}
 
-	item := elem.Value.(*cacheItem)
-	item.hits++
-	item.lastAccess = time.Now()
-	c.lru.MoveToFront(elem)
-	return cloneEntry(item.entry), true
+	s.evict.access(key)
+	return item.entry, true
 }
 
+// Set stores entry under key. The cache takes ownership: the caller must not
+// modify entry, its body or its header afterwards.
 func (c *Cache) Set(key string, entry *CacheEntry) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	entry.sizeBytes = estimateEntrySize(key, entry)
-	if elem, ok := c.store[key]; ok {
-		existing := elem.Value.(*cacheItem)
-		c.currentSize -= existing.entry.sizeBytes
-		existing.entry = cloneEntry(entry)
-		existing.hits++
-		existing.lastAccess = time.Now()
-		c.currentSize += existing.entry.sizeBytes
-		c.lru.MoveToFront(elem)
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !c.Admits(int64(len(entry.data))) {
+		if item, ok := s.store[key]; ok {
+			s.removeItem(item)
+		}
+		return
+	}
+
+	stored := entry.derive()
+	stored.sizeBytes = estimateEntrySize(key, entry)
+	if existing, ok := s.store[key]; ok {
+		s.currentSize -= existing.entry.sizeBytes
+		s.unindexTags(key, existing.entry.tags)
+		existing.entry = stored
+		s.currentSize += stored.sizeBytes
 	} else {
 		item := &cacheItem{
-			key:        key,
-			entry:      cloneEntry(entry),
-			hits:       1,
-			lastAccess: time.Now(),
+			key:   key,
+			entry: stored,
 		}
-		elem := c.lru.PushFront(item)
-		c.store[key] = elem
-		c.currentSize += item.entry.sizeBytes
+		s.store[key] = item
+		s.currentSize += item.entry.sizeBytes
 	}
+	s.evict.add(key, stored.sizeBytes)
+	s.indexTags(key, stored.tags)
 
-	c.evictIfNeeded()
+	s.evictIfNeeded()
 }
 
 func (c *Cache) SetWithTTL(key string, data []byte, header http.Header, statusCode int, ttl time.Duration) {
@@ -151,46 +335,148 @@ func cacheKey(r *http.Request) string {
 }
 
 func (c *Cache) Delete(key string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s := c.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if elem, ok := c.store[key]; ok {
-		c.removeElement(elem)
+	if item, ok := s.store[key]; ok {
+		s.removeItem(item)
 	}
 }
 
-func (c *Cache) Clear() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// DeleteMatching removes every entry whose key satisfies match and returns
+// the removed keys. Vary registrations for matching base keys are dropped too,
+// so the next response can register a fresh header list.
+func (c *Cache) DeleteMatching(match func(key string) bool) []string {
+	var removed []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, item := range s.store {
+			if match(key) {
+				s.removeItem(item)
+				removed = append(removed, key)
+			}
+		}
+		for baseKey := range s.varyByBase {
+			if match(baseKey) {
+				delete(s.varyByBase, baseKey)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return removed
+}
+
+// ExpireMatching soft-purges every entry whose key satisfies match and returns
+// the affected keys.
+func (c *Cache) ExpireMatching(match func(key string) bool) []string {
+	now := time.Now()
+	floor := c.alwaysOnline()
+	var expired []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key, item := range s.store {
+			if match(key) {
+				item.entry = softPurged(item.entry, floor, now)
+				expired = append(expired, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return expired
+}
+
+// ExpireTag soft-purges every entry tagged with tag and returns the affected
+// keys.
+func (c *Cache) ExpireTag(tag string) []string {
+	now := time.Now()
+	floor := c.alwaysOnline()
+	var expired []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key := range s.tagIndex[tag] {
+			if item, ok := s.store[key]; ok {
+				item.entry = softPurged(item.entry, floor, now)
+				expired = append(expired, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return expired
+}
+
+// DeleteTag removes every entry tagged with tag and returns the removed keys.
+func (c *Cache) DeleteTag(tag string) []string {
+	var removed []string
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for key := range s.tagIndex[tag] {
+			if item, ok := s.store[key]; ok {
+				s.removeItem(item)
+				removed = append(removed, key)
+			}
+		}
+		delete(s.tagIndex, tag)
+		s.mu.Unlock()
+	}
+	return removed
+}
 
-	c.store = make(map[string]*list.Element)
-	c.lru.Init()
-	c.currentSize = 0
-	c.varyByBase = make(map[string][]string)
+func (s *cacheShard) indexTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys := s.tagIndex[tag]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			s.tagIndex[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (s *cacheShard) unindexTags(key string, tags []string) {
+	for _, tag := range tags {
+		keys := s.tagIndex[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(s.tagIndex, tag)
+		}
+	}
+}
+
+func (c *Cache) Clear() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.reset()
+		s.mu.Unlock()
+	}
 }
 
 func (c *Cache) Close() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	c.Clear()
+}
 
-	c.store = make(map[string]*list.Element)
-	c.lru.Init()
-	c.currentSize = 0
-	c.varyByBase = make(map[string][]string)
+func (s *cacheShard) reset() {
+	s.store = make(map[string]*cacheItem)
+	s.evict = newEvictor(s.policy, s.maxBytes)
+	s.currentSize = 0
+	s.varyByBase = make(map[string]*varyState)
+	s.tagIndex = make(map[string]map[string]struct{})
 }
 
 func (c *Cache) StartCleanup() {
 	go func() {
 		for {
 			time.Sleep(c.ttl)
-			c.mu.Lock()
-			for _, elem := range c.store {
-				item := elem.Value.(*cacheItem)
-				if item.entry.expiresAt.Before(time.Now()) {
-					c.removeElement(elem)
+			for _, s := range c.shards {
+				s.mu.Lock()
+				now := time.Now()
+				for _, item := range s.store {
+					if item.entry.retainUntil(c.alwaysOnline()).Before(now) {
+						s.removeItem(item)
+					}
 				}
+				s.mu.Unlock()
 			}
-			c.mu.Unlock()
 		}
 	}()
 }
@@ -199,75 +485,94 @@ func (c *Cache) StopCleanup() {
 	c.Clear()
 }
 
+// SetMaxVariants caps how many Vary variants are kept per URL; storing one
+// more drops the oldest. n <= 0 means no cap.
+func (c *Cache) SetMaxVariants(n int) {
+	c.maxVariants.Store(int64(n))
+}
+
 func (c *Cache) LookupKey(baseKey string, r *http.Request) string {
-	c.mu.RLock()
-	varyHeaders := append([]string(nil), c.varyByBase[baseKey]...)
-	c.mu.RUnlock()
+	s := c.shardFor(baseKey)
+	s.mu.RLock()
+	var varyHeaders []string
+	if st := s.varyByBase[baseKey]; st != nil {
+		varyHeaders = st.headers
+	}
+	s.mu.RUnlock()
 	return buildCacheKey(baseKey, r, varyHeaders)
 }
 
-func (c *Cache) UpdateVary(baseKey string, responseHeader http.Header) bool {
+// UpdateVary records the Vary header list of a response for baseKey and
+// returns the key the response for r is stored under. ok is false when the
+// response cannot be cached (Vary: *).
+//
+// Variants that can no longer be reached, because the header list changed or
+// the URL went over its variant cap, are removed from memory and returned in
+// dropped so other tiers can remove them too.
+func (c *Cache) UpdateVary(baseKey string, r *http.Request, responseHeader http.Header) (key string, dropped []string, ok bool) {
 	headers, cacheable := parseVaryHeaders(responseHeader.Values("Vary"))
 	if !cacheable {
-		return false
+		return "", nil, false
+	}
+	key = buildCacheKey(baseKey, r, headers)
+
+	s := c.shardFor(baseKey)
+	s.mu.Lock()
+	st := s.varyByBase[baseKey]
+	if st == nil {
+		st = &varyState{}
+		s.varyByBase[baseKey] = st
+	}
+	if !slices.Equal(st.headers, headers) {
+		dropped = st.variants
+		st.headers = headers
+		st.variants = nil
+	}
+	if !slices.Contains(st.variants, key) {
+		st.variants = append(st.variants, key)
+		if limit := int(c.maxVariants.Load()); limit > 0 && len(st.variants) > limit {
+			n := len(st.variants) - limit
+			dropped = append(dropped, st.variants[:n]...)
+			st.variants = slices.Clone(st.variants[n:])
+		}
 	}
+	s.mu.Unlock()
 
-	c.mu.Lock()
-	c.varyByBase[baseKey] = headers
-	c.mu.Unlock()
-	return true
+	for _, k := range dropped {
+		if k != key {
+			c.Delete(k)
+		}
+	}
+	return key, dropped, true
 }
 
-func (c *Cache) removeElement(elem *list.Element) {
-	item := elem.Value.(*cacheItem)
-	c.currentSize -= item.entry.sizeBytes
-	delete(c.store, item.key)
-	c.lru.Remove(elem)
+func (s *cacheShard) removeItem(item *cacheItem) {
+	s.currentSize -= item.entry.sizeBytes
+	s.unindexTags(item.key, item.entry.tags)
+	delete(s.store, item.key)
+	s.evict.remove(item.key)
 }
 
-func (c *Cache) evictIfNeeded() {
-	if c.maxBytes <= 0 {
+func (s *cacheShard) evictIfNeeded() {
+	if s.maxBytes <= 0 {
 		return
 	}
-	for c.currentSize > c.maxBytes {
-		victim := c.selectVictim()
-		if victim == nil {
+	for s.currentSize > s.maxBytes {
+		key, ok := s.evict.victim()
+		if !ok {
 			return
 		}
-		c.removeElement(victim)
-	}
-}
-
-func (c *Cache) selectVictim() *list.Element {
-	if c.policy == EvictionLFU {
-		var (
-			victimElem *list.Element
-			minHits    uint64
-			minAccess  time.Time
-		)
-		for _, elem := range c.store {
-			item := elem.Value.(*cacheItem)
-			if victimElem == nil ||
-				item.hits < minHits ||
-				(item.hits == minHits && item.lastAccess.Before(minAccess)) {
-				victimElem = elem
-				minHits = item.hits
-				minAccess = item.lastAccess
-			}
+		if item, found := s.store[key]; found {
+			s.removeItem(item)
 		}
-		return victimElem
 	}
-	return c.lru.Back()
 }
 
-func cloneEntry(entry *CacheEntry) *CacheEntry {
-	if entry == nil {
-		return nil
-	}
-	cloned := *entry
-	cloned.header = entry.header.Clone()
-	cloned.data = append([]byte(nil), entry.data...)
-	return &cloned
+// softPurged returns a soft-purged copy of a published entry.
+func softPurged(entry *CacheEntry, alwaysOnline time.Duration, now time.Time) *CacheEntry {
+	purged := entry.derive()
+	purged.softPurge(alwaysOnline, now)
+	return purged
 }
 
 func estimateEntrySize(key string, entry *CacheEntry) int64 {
@@ -295,11 +600,50 @@ func buildCacheKey(baseKey string, r *http.Request, varyHeaders []string) string
 		b.WriteString("|")
 		b.WriteString(h)
 		b.WriteString("=")
-		b.WriteString(strings.TrimSpace(r.Header.Get(h)))
+		b.WriteString(varyValue(r.Header.Values(h)))
 	}
 	return b.String()
 }
 
+// varyValue is the canonical form of a request header for the cache key:
+// repeated fields joined and the whitespace around list items dropped, so
+// equivalent spellings share a variant.
+func varyValue(values []string) string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.Join(strings.Fields(item), " "); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// parseSurrogateKeys collects cache tags from Surrogate-Key (space separated)
+// and Cache-Tag (comma separated) response headers.
+func parseSurrogateKeys(header http.Header) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	add := func(tag string) {
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, v := range header.Values("Surrogate-Key") {
+		for _, tag := range strings.Fields(v) {
+			add(tag)
+		}
+	}
+	for _, v := range header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(v, ",") {
+			add(strings.TrimSpace(tag))
+		}
+	}
+	return tags
+}
+
 func parseVaryHeaders(varyValues []string) ([]string, bool) {
 	seen := make(map[string]bool)
 	var headers []string
@@ -322,49 +666,24 @@ func parseVaryHeaders(varyValues []string) ([]string, bool) {
 	return headers, true
 }
 
-// get ttl
-
-func getTTL(resp *http.Response) time.Duration {
+// getStaleWhileRevalidate returns the RFC 5861 stale-while-revalidate window
+// of a response, or 0 if it has none.
+func getStaleWhileRevalidate(resp *http.Response) time.Duration {
 	if resp == nil {
 		return 0
 	}
+	_, maxAges := parseCacheControl(resp.Header.Values("Cache-Control"))
+	return time.Duration(maxAges["stale-while-revalidate"]) * time.Second
+}
 
-	flags, maxAges := parseCacheControl(resp.Header.Values("Cache-Control"))
-
-	// This cache does not support validation (ETag / If-None-Match) yet,
-	// so treat revalidation-required responses as uncacheable.
-	if flags["no-store"] || flags["no-cache"] {
-		return 0
-	}
-
-	freshnessSeconds := int64(-1)
-	if v, ok := maxAges["s-maxage"]; ok {
-		freshnessSeconds = v
-	} else if v, ok := maxAges["max-age"]; ok {
-		freshnessSeconds = v
-	} else if expires := resp.Header.Get("Expires"); expires != "" {
-		if expTime, err := http.ParseTime(expires); err == nil {
-			base := time.Now()
-			if date := resp.Header.Get("Date"); date != "" {
-				if dateTime, err := http.ParseTime(date); err == nil {
-					base = dateTime
-				}
-			}
-			freshnessSeconds = int64(expTime.Sub(base) / time.Second)
-		}
-	}
-
-	if freshnessSeconds <= 0 {
-		return 0
-	}
-
-	ageSeconds := parseAgeHeader(resp.Header.Get("Age"))
-	remaining := freshnessSeconds - ageSeconds
-	if remaining <= 0 {
+// getStaleIfError returns the RFC 5861 stale-if-error window of a response,
+// or 0 if it has none.
+func getStaleIfError(resp *http.Response) time.Duration {
+	if resp == nil {
 		return 0
 	}
-
-	return time.Duration(remaining) * time.Second
+	_, maxAges := parseCacheControl(resp.Header.Values("Cache-Control"))
+	return time.Duration(maxAges["stale-if-error"]) * time.Second
 }
 
 func parseCacheControl(headers []string) (map[string]bool, map[string]int64) {
@@ -394,7 +713,8 @@ func parseCacheControl(headers []string) (map[string]bool, map[string]int64) {
 				value = unquoted
 			}
 
-			if name == "max-age" || name == "s-maxage" {
+			switch name {
+			case "max-age", "s-maxage", "stale-while-revalidate", "stale-if-error", "max-stale", "min-fresh":
 				seconds, err := strconv.ParseInt(value, 10, 64)
 				if err != nil || seconds < 0 {
 					continue
@@ -405,7 +725,8 @@ func parseCacheControl(headers []string) (map[string]bool, map[string]int64) {
 				}
 			}
 
-			if name == "no-cache" || name == "no-store" {
+			// The field-list forms are treated like the plain directives.
+			if name == "no-cache" || name == "no-store" || name == "private" {
 				flags[name] = true
 			}
 		}
@@ -461,13 +782,40 @@ func parseAgeHeader(ageValue string) int64 {
 func main() {
 	cfg := loadEdgeConfigFromEnv()
 
-	cache := NewCache(10*time.Minute, cfg.MaxMemoryBytes)
+	cache := NewShardedCache(10*time.Minute, cfg.MaxMemoryBytes, cfg.CacheShards)
 	cache.SetEvictionPolicy(EvictionPolicy(strings.ToLower(getEnv("EDGE_EVICTION_POLICY", "lru"))))
+	cache.SetMaxObjectBytes(cfg.MaxMemoryObjectBytes)
+	cache.SetAlwaysOnline(cfg.AlwaysOnline)
+	cache.SetMaxVariants(cfg.MaxVariants)
 
 	disk, err := NewDiskCache(cfg.DiskCacheDir, cfg.DiskCacheMaxBytes)
 	if err != nil {
 		log.Fatalf("failed to initialize disk cache: %v", err)
 	}
+	disk.SetAlwaysOnline(cfg.AlwaysOnline)
+	if err := disk.SetEvictionWatermarks(cfg.DiskEvictHighPercent, cfg.DiskEvictLowPercent); err != nil {
+		log.Fatalf("invalid EDGE_DISK_EVICT_HIGH_PERCENT/EDGE_DISK_EVICT_LOW_PERCENT: %v", err)
+	}
+	tagPriorities, err := parseTagPriorities(cfg.DiskTagPriority)
+	if err != nil {
+		log.Fatalf("invalid EDGE_DISK_TAG_PRIORITY: %v", err)
+	}
+	disk.SetTagPriorities(tagPriorities)
+	disk.StartEvictor()
+	disk.StartAccessFlusher(cfg.DiskAccessFlush)
+	disk.StartWriters(cfg.DiskWriters, cfg.DiskWriteQueue)
+	disk.StartVerifier()
+	disk.StartIndexRebuild()
+
+	ttlRules, err := parseTTLRules(cfg.TTLRules)
+	if err != nil {
+		log.Fatalf("invalid EDGE_TTL_RULES: %v", err)
+	}
+
+	keyRules, err := parseKeyRules(cfg.CacheKeyRules)
+	if err != nil {
+		log.Fatalf("invalid EDGE_CACHE_KEY_RULES: %v", err)
+	}
 
 	origins := cfg.Origins
 	if len(origins) == 0 {
@@ -487,8 +835,44 @@ func main() {
 		disk:    disk,
 		client:  newUpstreamClient(cfg),
 		ring:    ring,
+
+		upstreamIdle: cfg.ClientTimeout,
+
+		alwaysOnline: cfg.AlwaysOnline,
+		exposeTags:   cfg.ExposeSurrogateKeys,
+		keys:         &cacheKeyer{rules: keyRules},
+		vary:         newVaryNormalizer(cfg.VaryEncodings, cfg.VaryLanguages),
+		compress:     newCompressor(cfg.CompressEncodings, cfg.CompressTypes, cfg.CompressMinBytes, cfg.CompressMaxBytes),
+		maxRanges:    cfg.MaxRanges,
+		sliceSize:    cfg.SliceBytes,
+		promoteMax:   cfg.DiskPromoteMaxBytes,
+		shareMax:     cfg.SharedBodyMaxBytes,
+		clientCache:  normalizeClientCachePolicy(ClientCachePolicy(cfg.ClientCacheControl)),
+		ttl: &ttlPolicy{
+			heuristicPercent: cfg.HeuristicPercent,
+			heuristicMax:     cfg.HeuristicMax,
+			rules:            ttlRules,
+			validationWindow: cfg.ValidationWindow,
+		},
 	}
 	cache.StartCleanup()
+
+	if cfg.AdminListenAddr != "" {
+		if cfg.AdminToken == "" {
+			log.Fatal("EDGE_ADMIN_TOKEN is required when EDGE_ADMIN_LISTEN_ADDR is set")
+		}
+		admin := &http.Server{
+			Addr:         cfg.AdminListenAddr,
+			Handler:      newAdminHandler(proxy, cfg.AdminToken),
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go func() {
+			log.Printf("Admin server listening on %s", cfg.AdminListenAddr)
+			log.Fatal(admin.ListenAndServe())
+		}()
+	}
+
 	http.HandleFunc("/", proxy.ServeHTTP)
 	log.Printf("Edge server listening on %s (origins=%v shield=%q)", cfg.ListenAddr, origins, cfg.ShieldURL)
 
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// purgeMethods are the request methods that end up in the cache; every base
+// key starts with one of them.
+var purgeMethods = []string{"GET", "HEAD"}
+
+type purgeResult struct {
+	Purged int  `json:"purged"`
+	Memory int  `json:"memory"`
+	Disk   int  `json:"disk"`
+	Soft   bool `json:"soft,omitempty"`
+}
+
+// purge removes every entry matching match from both tiers. Purged counts
+// distinct keys, so an object held in memory and on disk counts once.
+//
+// A soft purge expires the entries instead of deleting them: the next request
+// revalidates with the stored ETag/Last-Modified, and the old copy remains a
+// fallback if the origin fails.
+func (es *EdgeServer) purge(match func(key string) bool, soft bool) purgeResult {
+	if soft {
+		return mergePurged(es.cache.ExpireMatching(match), es.disk.ExpireMatching(match), true)
+	}
+	return mergePurged(es.cache.DeleteMatching(match), es.disk.DeleteMatching(match), false)
+}
+
+func mergePurged(memKeys, diskKeys []string, soft bool) purgeResult {
+	seen := make(map[string]bool, len(memKeys)+len(diskKeys))
+	for _, k := range memKeys {
+		seen[k] = true
+	}
+	for _, k := range diskKeys {
+		seen[k] = true
+	}
+	return purgeResult{Purged: len(seen), Memory: len(memKeys), Disk: len(diskKeys), Soft: soft}
+}
+
+// PurgeURL removes one URL, including every Vary variant stored for it.
+func (es *EdgeServer) PurgeURL(rawURL string, soft bool) (purgeResult, error) {
+	u, err := parsePurgeURL(rawURL)
+	if err != nil {
+		return purgeResult{}, err
+	}
+	bases := make([]string, 0, len(purgeMethods))
+	for _, m := range purgeMethods {
+		bases = append(bases, es.keys.purgeKey(m, u, false))
+	}
+	return es.purge(func(key string) bool {
+		for _, base := range bases {
+			if key == base || strings.HasPrefix(key, base+"|") {
+				return true
+			}
+		}
+		return false
+	}, soft), nil
+}
+
+// PurgePrefix removes every URL starting with prefix.
+func (es *EdgeServer) PurgePrefix(rawPrefix string, soft bool) (purgeResult, error) {
+	u, err := parsePurgeURL(rawPrefix)
+	if err != nil {
+		return purgeResult{}, err
+	}
+	prefixes := make([]string, 0, len(purgeMethods))
+	for _, m := range purgeMethods {
+		prefixes = append(prefixes, es.keys.purgeKey(m, u, true))
+	}
+	return es.purge(func(key string) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}, soft), nil
+}
+
+// PurgeTag removes every entry stored with the given Surrogate-Key / Cache-Tag.
+func (es *EdgeServer) PurgeTag(tag string, soft bool) purgeResult {
+	if soft {
+		return mergePurged(es.cache.ExpireTag(tag), es.disk.ExpireTag(tag), true)
+	}
+	return mergePurged(es.cache.DeleteTag(tag), es.disk.DeleteTag(tag), false)
+}
+
+// PurgeAll empties both tiers, or expires everything in them when soft.
+func (es *EdgeServer) PurgeAll(soft bool) purgeResult {
+	return es.purge(func(string) bool { return true }, soft)
+}
+
+// parsePurgeURL accepts either an absolute URL or a path. The host of an
+// absolute URL only matters to key rules that include it.
+func parsePurgeURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u, nil
+}
@@ -2,12 +2,54 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-func writeResponseWithRange(w http.ResponseWriter, r *http.Request, statusCode int, header http.Header, body []byte) {
+// rangeCoalesceGap is how far apart two ranges may be and still be sent as
+// one part: about what the boundary and part headers between them cost.
+const rangeCoalesceGap = 80
+
+// entryBody is where a response body is served from: a *bytes.Reader over
+// bytes in memory, or the file of a disk entry.
+type entryBody interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// copyRange copies n bytes of body from offset start to dst. A disk body is
+// read from its file directly rather than through a SectionReader, so that
+// io.Copy can hand the transfer to sendfile when dst is the connection.
+func copyRange(dst io.Writer, body entryBody, start, n int64) error {
+	if f, ok := body.(*diskBody); ok {
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(dst, f.File, n)
+		return err
+	}
+	_, err := io.Copy(dst, io.NewSectionReader(body, start, n))
+	return err
+}
+
+// byteRange is an inclusive range of body offsets.
+type byteRange struct {
+	start, end int64
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// writeResponseWithRange writes body, or the parts of it r asks for. A Range
+// that is malformed, names more than maxRanges ranges, or fails If-Range is
+// ignored and the whole body sent; one that body cannot satisfy gets a 416.
+func (es *EdgeServer) writeResponseWithRange(w http.ResponseWriter, r *http.Request, statusCode int, header http.Header, body entryBody) {
 	w.Header().Set("Accept-Ranges", "bytes")
 
 	if r.Method == http.MethodHead {
@@ -15,70 +57,143 @@ func writeResponseWithRange(w http.ResponseWriter, r *http.Request, statusCode i
 		return
 	}
 
+	size := body.Size()
 	rangeHeader := r.Header.Get("Range")
-	if rangeHeader == "" || statusCode != http.StatusOK || len(body) == 0 {
+	if rangeHeader == "" || statusCode != http.StatusOK || !ifRangeAllows(r, header) {
 		w.WriteHeader(statusCode)
-		_, _ = w.Write(body)
+		_ = copyRange(w, body, 0, size)
 		return
 	}
 
-	start, end, ok := parseSingleByteRange(rangeHeader, int64(len(body)))
+	ranges, ok := parseByteRanges(rangeHeader, size, es.maxRanges)
 	if !ok {
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(body)))
+		w.WriteHeader(statusCode)
+		_ = copyRange(w, body, 0, size)
+		return
+	}
+	if len(ranges) == 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
 		http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
+	ranges = coalesceRanges(ranges)
+
+	if len(ranges) == 1 {
+		br := ranges[0]
+		w.Header().Set("Content-Range", br.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(br.end-br.start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_ = copyRange(w, body, br.start, br.end-br.start+1)
+		return
+	}
 
-	chunk := body[start : end+1]
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
-	w.Header().Set("Content-Length", strconv.Itoa(len(chunk)))
+	// The parts are streamed as they are read, so the multipart body goes
+	// out without a Content-Length.
+	mw := multipart.NewWriter(w)
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
 	w.WriteHeader(http.StatusPartialContent)
-	_, _ = w.Write(chunk)
+	contentType := header.Get("Content-Type")
+	for _, br := range ranges {
+		partHeader := textproto.MIMEHeader{"Content-Range": {br.contentRange(size)}}
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		part, err := mw.CreatePart(partHeader)
+		if err != nil || copyRange(part, body, br.start, br.end-br.start+1) != nil {
+			return
+		}
+	}
+	_ = mw.Close()
 }
 
-func parseSingleByteRange(raw string, size int64) (start, end int64, ok bool) {
-	if !strings.HasPrefix(raw, "bytes=") {
-		return 0, 0, false
+// parseByteRanges parses a Range header against a body of size bytes. ok is
+// false when the header should be ignored: it is malformed, not in bytes, or
+// lists more than maxRanges ranges (when maxRanges > 0). Otherwise ranges
+// holds the satisfiable ones, clamped to the body, and is empty if none are.
+func parseByteRanges(raw string, size int64, maxRanges int) (ranges []byteRange, ok bool) {
+	unit, set, found := strings.Cut(raw, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, false
 	}
-	spec := strings.TrimSpace(strings.TrimPrefix(raw, "bytes="))
-	if spec == "" || strings.Contains(spec, ",") {
-		return 0, 0, false
+	specs := strings.Split(set, ",")
+	if maxRanges > 0 && len(specs) > maxRanges {
+		return nil, false
 	}
 
-	parts := strings.SplitN(spec, "-", 2)
-	if len(parts) != 2 {
-		return 0, 0, false
-	}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		startPart, endPart, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, false
+		}
+		startPart, endPart = strings.TrimSpace(startPart), strings.TrimSpace(endPart)
 
-	startPart := strings.TrimSpace(parts[0])
-	endPart := strings.TrimSpace(parts[1])
+		if startPart == "" {
+			// suffix-byte-range-spec: bytes=-N
+			n, err := strconv.ParseInt(endPart, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			ranges = append(ranges, byteRange{start: max(size-n, 0), end: size - 1})
+			continue
+		}
 
-	switch {
-	case startPart == "":
-		// suffix-byte-range-spec: bytes=-N
-		n, err := strconv.ParseInt(endPart, 10, 64)
-		if err != nil || n <= 0 {
-			return 0, 0, false
+		s, err := strconv.ParseInt(startPart, 10, 64)
+		if err != nil || s < 0 {
+			return nil, false
 		}
-		if n > size {
-			n = size
+		e := size - 1
+		if endPart != "" {
+			e, err = strconv.ParseInt(endPart, 10, 64)
+			if err != nil || e < s {
+				return nil, false
+			}
+			e = min(e, size-1)
 		}
-		return size - n, size - 1, true
-	case endPart == "":
-		s, err := strconv.ParseInt(startPart, 10, 64)
-		if err != nil || s < 0 || s >= size {
-			return 0, 0, false
+		if s >= size {
+			continue
 		}
-		return s, size - 1, true
-	default:
-		s, err1 := strconv.ParseInt(startPart, 10, 64)
-		e, err2 := strconv.ParseInt(endPart, 10, 64)
-		if err1 != nil || err2 != nil || s < 0 || e < s || s >= size {
-			return 0, 0, false
+		ranges = append(ranges, byteRange{start: s, end: e})
+	}
+	if len(ranges) == 0 && !hasRangeSpec(specs) {
+		return nil, false
+	}
+	return ranges, true
+}
+
+func hasRangeSpec(specs []string) bool {
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) != "" {
+			return true
 		}
-		if e >= size {
-			e = size - 1
+	}
+	return false
+}
+
+// coalesceRanges merges ranges that overlap or lie within rangeCoalesceGap
+// of each other, so a client cannot make the edge send the same bytes twice
+// (RFC 9110 §14.2). The result is in body order.
+func coalesceRanges(ranges []byteRange) []byteRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := append([]byteRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+	out := sorted[:1]
+	for _, br := range sorted[1:] {
+		last := &out[len(out)-1]
+		if br.start <= last.end+1+rangeCoalesceGap {
+			last.end = max(last.end, br.end)
+			continue
 		}
-		return s, e, true
+		out = append(out, br)
 	}
+	return out
 }
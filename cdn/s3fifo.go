@@ -0,0 +1,139 @@
+package main
+
+import "container/list"
+
+// s3SmallPercent is the share of cached bytes given to the S3-FIFO probation
+// queue.
+const s3SmallPercent = 10
+
+// s3fifoEvictor implements S3-FIFO (Yang et al., SOSP '23). New keys enter a
+// small FIFO; keys hit more than once there are promoted to the main FIFO, the
+// rest are evicted quickly and remembered in a ghost queue so that a prompt
+// re-request goes straight to main. Main is a FIFO with lazy reinsertion of
+// keys that were hit while queued. Queue shares are measured in bytes.
+type s3fifoEvictor struct {
+	small      *list.List // of *s3Node, newest first
+	main       *list.List // of *s3Node, newest first
+	ghost      *list.List // of string, newest first
+	ghostKeys  map[string]*list.Element
+	nodes      map[string]*s3Node
+	smallBytes int64
+	mainBytes  int64
+}
+
+type s3Node struct {
+	key    string
+	size   int64
+	freq   uint8
+	inMain bool
+	elem   *list.Element
+}
+
+func newS3FIFOEvictor() *s3fifoEvictor {
+	return &s3fifoEvictor{
+		small:     list.New(),
+		main:      list.New(),
+		ghost:     list.New(),
+		ghostKeys: make(map[string]*list.Element),
+		nodes:     make(map[string]*s3Node),
+	}
+}
+
+func (e *s3fifoEvictor) add(key string, size int64) {
+	if node, ok := e.nodes[key]; ok {
+		e.resize(node, size)
+		e.access(key)
+		return
+	}
+	node := &s3Node{key: key, size: size}
+	if g, ok := e.ghostKeys[key]; ok {
+		e.ghost.Remove(g)
+		delete(e.ghostKeys, key)
+		e.pushMain(node)
+	} else {
+		node.elem = e.small.PushFront(node)
+		e.smallBytes += size
+	}
+	e.nodes[key] = node
+}
+
+func (e *s3fifoEvictor) access(key string) {
+	if node, ok := e.nodes[key]; ok && node.freq < 3 {
+		node.freq++
+	}
+}
+
+func (e *s3fifoEvictor) remove(key string) {
+	if node, ok := e.nodes[key]; ok {
+		e.unlink(node)
+		delete(e.nodes, key)
+	}
+}
+
+func (e *s3fifoEvictor) victim() (string, bool) {
+	for {
+		smallFull := e.smallBytes*100 >= (e.smallBytes+e.mainBytes)*s3SmallPercent
+		switch {
+		case e.small.Len() > 0 && (smallFull || e.main.Len() == 0):
+			node := e.small.Back().Value.(*s3Node)
+			e.unlink(node)
+			if node.freq > 1 {
+				node.freq = 0
+				e.pushMain(node)
+				continue
+			}
+			delete(e.nodes, node.key)
+			e.remember(node.key)
+			return node.key, true
+		case e.main.Len() > 0:
+			node := e.main.Back().Value.(*s3Node)
+			if node.freq > 0 {
+				node.freq--
+				e.main.MoveToFront(node.elem)
+				continue
+			}
+			e.unlink(node)
+			delete(e.nodes, node.key)
+			return node.key, true
+		default:
+			return "", false
+		}
+	}
+}
+
+func (e *s3fifoEvictor) pushMain(node *s3Node) {
+	node.inMain = true
+	node.elem = e.main.PushFront(node)
+	e.mainBytes += node.size
+}
+
+func (e *s3fifoEvictor) unlink(node *s3Node) {
+	if node.inMain {
+		e.main.Remove(node.elem)
+		e.mainBytes -= node.size
+	} else {
+		e.small.Remove(node.elem)
+		e.smallBytes -= node.size
+	}
+	node.inMain = false
+}
+
+func (e *s3fifoEvictor) resize(node *s3Node, size int64) {
+	if node.inMain {
+		e.mainBytes += size - node.size
+	} else {
+		e.smallBytes += size - node.size
+	}
+	node.size = size
+}
+
+// remember adds key to the ghost queue, which holds at most as many keys as
+// are resident.
+func (e *s3fifoEvictor) remember(key string) {
+	e.ghostKeys[key] = e.ghost.PushFront(key)
+	for e.ghost.Len() > len(e.nodes) && e.ghost.Len() > 0 {
+		oldest := e.ghost.Back()
+		e.ghost.Remove(oldest)
+		delete(e.ghostKeys, oldest.Value.(string))
+	}
+}
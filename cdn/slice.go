@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errSliceChanged means a slice does not belong to the same version of the
+// object as the others, so they cannot be combined.
+var errSliceChanged = errors.New("object changed between slices")
+
+// errNoRanges means the upstream answered a slice request with the whole
+// object.
+var errNoRanges = errors.New("upstream does not support range requests")
+
+// noRangesRetry is how long an upstream that ignored a slice request is sent
+// whole-object requests before slicing is tried on it again.
+const noRangesRetry = 10 * time.Minute
+
+// slicedObject is what a request learns about an object whose slices it is
+// assembling. Every slice must carry the same size and validator as the
+// first one (RFC 9111 §3.4).
+type slicedObject struct {
+	baseKey string
+	// key is the variant key slice keys hang off; it changes when an origin
+	// response shows the object varies.
+	key          string
+	size         int64
+	eTag         string
+	lastModified string
+	// first is the slice the object was learnt from, kept so it is not
+	// fetched twice when nothing may be cached. firstBody is its body file
+	// if it is served from disk; serveSliced closes it.
+	first      *CacheEntry
+	firstBody  *diskBody
+	firstIndex int64
+}
+
+// validator identifies the version of the object: its ETag, or failing
+// that its Last-Modified.
+func (o *slicedObject) validator() string {
+	if o.eTag != "" {
+		return o.eTag
+	}
+	return o.lastModified
+}
+
+func (o *slicedObject) matches(entry *CacheEntry) bool {
+	size, ok := sliceTotal(entry.header)
+	return ok && size == o.size && entry.eTag == o.eTag && entry.lastModified == o.lastModified
+}
+
+func sliceKey(key string, index int64) string {
+	return key + "|slice=" + strconv.FormatInt(index, 10)
+}
+
+// sliceResult is what a slice fetch hands its singleflight waiters.
+type sliceResult struct {
+	entry *CacheEntry
+	key   string
+}
+
+// serveSliced answers a Range request from fixed-size slices of the object,
+// each fetched from origin with its own Range request and cached under its
+// own key. Requests it cannot slice go to origin uncached, as before, unless
+// the upstream ignores Range, in which case the whole object is cached.
+func (es *EdgeServer) serveSliced(w http.ResponseWriter, r *http.Request, baseKey, key string, cc requestDirectives) {
+	rangeHeader := r.Header.Get("Range")
+	// Parsed against an unknown size, a suffix range lands near MaxInt64;
+	// the object size comes from the first slice, so start with slice 0.
+	ranges, ok := parseByteRanges(rangeHeader, math.MaxInt64, es.maxRanges)
+	if !ok || len(ranges) == 0 {
+		es.serveNoCache(w, r)
+		return
+	}
+	probe := int64(0)
+	if ranges[0].start < math.MaxInt64/2 {
+		probe = ranges[0].start / es.sliceSize
+	}
+
+	obj := &slicedObject{baseKey: baseKey, key: key}
+	first, firstBody, cached, err := es.loadSlice(r, obj, probe, cc)
+	defer firstBody.Close()
+	if errors.Is(err, errNoRanges) {
+		es.serveMiss(w, r, baseKey, key, cc)
+		return
+	}
+	if err != nil {
+		es.serveNoCache(w, r)
+		return
+	}
+	obj.size, _ = sliceTotal(first.header)
+	obj.eTag, obj.lastModified = first.eTag, first.lastModified
+	obj.first, obj.firstBody, obj.firstIndex = first, firstBody, probe
+
+	header := first.header.Clone()
+	header.Del("Content-Range")
+	header.Del("Content-Length")
+	if !ifRangeAllows(r, header) {
+		es.serveNoCache(w, r)
+		return
+	}
+
+	copyHeaders(w.Header(), header)
+	if es.compress.eligible(http.StatusOK, header, obj.size) {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	if cached {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	setAge(w.Header(), first, time.Now())
+	if notModified(r, http.StatusOK, obj.eTag, obj.lastModified) {
+		writeNotModified(w, header)
+		return
+	}
+
+	ranges, _ = parseByteRanges(rangeHeader, obj.size, es.maxRanges)
+	if len(ranges) == 0 {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", obj.size))
+		http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	ranges = coalesceRanges(ranges)
+
+	// The status line is out before the later slices are fetched, so a
+	// failure past this point can only cut the response short, and the
+	// connection is reset so the client does not take it for complete.
+	if len(ranges) == 1 {
+		br := ranges[0]
+		w.Header().Set("Content-Range", br.contentRange(obj.size))
+		w.Header().Set("Content-Length", strconv.FormatInt(br.end-br.start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		if es.writeSlices(w, r, obj, br, cc) != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
+	contentType := header.Get("Content-Type")
+	for _, br := range ranges {
+		partHeader := textproto.MIMEHeader{"Content-Range": {br.contentRange(obj.size)}}
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		part, err := mw.CreatePart(partHeader)
+		if err != nil || es.writeSlices(part, r, obj, br, cc) != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+	_ = mw.Close()
+}
+
+// writeSlices copies the bytes of br to dst slice by slice. If a slice turns
+// out to be from another version of the object, every slice of it is
+// dropped so the next request starts over.
+func (es *EdgeServer) writeSlices(dst io.Writer, r *http.Request, obj *slicedObject, br byteRange, cc requestDirectives) error {
+	for index := br.start / es.sliceSize; index*es.sliceSize <= br.end; index++ {
+		entry, file, _, err := es.loadSlice(r, obj, index, cc)
+		if err != nil {
+			if errors.Is(err, errSliceChanged) {
+				es.dropSlices(obj)
+			}
+			return err
+		}
+		offset := index * es.sliceSize
+		err = writeSlice(dst, entry, file, max(br.start, offset)-offset, br.end-offset)
+		if file != obj.firstBody {
+			_ = file.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSlice copies bytes from through to of a slice to dst, from its body
+// file if it has one or else from memory. to may lie past the slice's end.
+func writeSlice(dst io.Writer, entry *CacheEntry, file *diskBody, from, to int64) error {
+	var body entryBody = bytes.NewReader(entry.data)
+	if file != nil {
+		body = file
+	}
+	to = min(to, body.Size()-1)
+	if to < from {
+		return io.ErrUnexpectedEOF
+	}
+	return copyRange(dst, body, from, to-from+1)
+}
+
+// loadSlice returns slice index of obj from the tiers, or from origin if it
+// is missing, not fresh enough for the client, or of another version than
+// obj. cached reports whether it came from the tiers. A slice from disk too
+// large to promote has its body in the returned file, which the caller
+// closes unless it is obj.firstBody.
+func (es *EdgeServer) loadSlice(r *http.Request, obj *slicedObject, index int64, cc requestDirectives) (entry *CacheEntry, file *diskBody, cached bool, err error) {
+	if obj.first != nil && index == obj.firstIndex {
+		return obj.first, obj.firstBody, true, nil
+	}
+	key := sliceKey(obj.key, index)
+	known := obj.validator() != "" || obj.size > 0
+	usable := func(e *CacheEntry) bool {
+		return cc.acceptsFresh(e, time.Now()) && (!known || obj.matches(e))
+	}
+	if e, found := es.cache.Get(key); found && usable(e) {
+		return e, nil, true, nil
+	}
+	if e, file, found := es.disk.Open(key); found {
+		if usable(e) {
+			e, file = es.promote(key, e, file)
+			return e, file, true, nil
+		}
+		_ = file.Close()
+	}
+
+	result, err, _ := es.inflight.Do(key, func() (interface{}, error) {
+		return es.fetchSlice(r, obj, index)
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	res := result.(*sliceResult)
+	if known && !obj.matches(res.entry) {
+		// Fetched for another request that had not seen this version.
+		return nil, nil, false, errSliceChanged
+	}
+	if res.key != "" {
+		obj.key = res.key
+	}
+	return res.entry, nil, false, nil
+}
+
+// fetchSlice gets one slice from origin and caches it. Once the version is
+// known, a strong ETag is sent as If-Match so a changed object fails the
+// fetch instead of returning bytes of the new version.
+func (es *EdgeServer) fetchSlice(r *http.Request, obj *slicedObject, index int64) (*sliceResult, error) {
+	start := index * es.sliceSize
+	req := es.originRequest(r, obj.key)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+es.sliceSize-1))
+	if obj.eTag != "" && !strings.HasPrefix(obj.eTag, "W/") {
+		req.Header.Set("If-Match", obj.eTag)
+	}
+
+	requestTime := time.Now()
+	resp, err := es.doUpstream(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	responseTime := time.Now()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		es.noRanges.Store(es.chooseUpstream(obj.key), time.Now().Add(noRangesRetry))
+		return nil, errNoRanges
+	case http.StatusPreconditionFailed:
+		return nil, errSliceChanged
+	default:
+		return nil, fmt.Errorf("origin answered slice request with %d", resp.StatusCode)
+	}
+	first, last, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || first != start || last != min(start+es.sliceSize, size)-1 {
+		return nil, fmt.Errorf("origin sent range %q for slice %d", resp.Header.Get("Content-Range"), index)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, es.sliceSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != last-first+1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	initialAge := correctedInitialAge(resp.Header, requestTime, responseTime)
+	entry := &CacheEntry{
+		data:         body,
+		header:       es.clientHeader(resp.Header),
+		statusCode:   resp.StatusCode,
+		createdAt:    responseTime,
+		initialAge:   initialAge,
+		eTag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		tags:         parseSurrogateKeys(resp.Header),
+
+		staleWhileRevalidate: getStaleWhileRevalidate(resp),
+		staleIfError:         getStaleIfError(resp),
+	}
+	res := &sliceResult{entry: entry}
+
+	// Without a validator there is no telling slices of different versions
+	// apart, so those are served but never kept.
+	fresh := es.ttl.decide(resp.StatusCode, resp.Header, initialAge)
+	if !fresh.store || (entry.eTag == "" && entry.lastModified == "") {
+		return res, nil
+	}
+	key, dropped, ok := es.cache.UpdateVary(obj.baseKey, r, resp.Header)
+	es.dropVariants(key, dropped)
+	if !ok {
+		return res, nil
+	}
+	fresh.apply(entry, entry.createdAt)
+	es.cache.Set(sliceKey(key, index), entry)
+	es.disk.Set(sliceKey(key, index), entry)
+	res.key = key
+	return res, nil
+}
+
+// upstreamRanges reports whether Range misses on key are fetched in slices,
+// which they are unless its upstream recently ignored a slice request.
+func (es *EdgeServer) upstreamRanges(key string) bool {
+	upstream := es.chooseUpstream(key)
+	until, ok := es.noRanges.Load(upstream)
+	if !ok {
+		return true
+	}
+	if time.Now().Before(until.(time.Time)) {
+		return false
+	}
+	es.noRanges.CompareAndDelete(upstream, until)
+	return true
+}
+
+// dropSlices removes every cached slice of obj.
+func (es *EdgeServer) dropSlices(obj *slicedObject) {
+	for index := int64(0); index*es.sliceSize < obj.size; index++ {
+		key := sliceKey(obj.key, index)
+		es.cache.Delete(key)
+		es.disk.Delete(key)
+	}
+}
+
+// sliceTotal returns the complete length of the object a slice came from.
+func sliceTotal(h http.Header) (int64, bool) {
+	_, _, size, ok := parseContentRange(h.Get("Content-Range"))
+	return size, ok
+}
+
+// parseContentRange parses a "bytes first-last/complete" Content-Range. An
+// unknown complete length ("*") is not accepted.
+func parseContentRange(v string) (first, last, size int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	a, b, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err1, err2, err3 error
+	first, err1 = strconv.ParseInt(a, 10, 64)
+	last, err2 = strconv.ParseInt(b, 10, 64)
+	size, err3 = strconv.ParseInt(total, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || first < 0 || last < first || last >= size {
+		return 0, 0, 0, false
+	}
+	return first, last, size, true
+}
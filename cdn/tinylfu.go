@@ -0,0 +1,248 @@
+package main
+
+import (
+	"container/list"
+	"hash/maphash"
+)
+
+const (
+	// tinyLFUWindowPercent is the share of cached bytes held by the admission
+	// window; the rest is the main segmented LRU.
+	tinyLFUWindowPercent = 1
+	// tinyLFUProtectedPercent is the share of the main area reserved for keys
+	// that were hit again after admission.
+	tinyLFUProtectedPercent = 80
+)
+
+type tinyLFUSegment uint8
+
+const (
+	segWindow tinyLFUSegment = iota
+	segProbation
+	segProtected
+)
+
+// tinyLFUEvictor implements W-TinyLFU (Einziger et al., as used by Caffeine).
+// New keys enter a small LRU window. When the window is over its share, its
+// oldest key moves into the main area; once that is full it has to compete
+// against the main area's next victim and only the one with the higher
+// estimated frequency stays. The main area is a segmented LRU
+// (probation/protected). Frequencies come from an aging count-min sketch, so
+// popularity is remembered even for keys that are not resident.
+type tinyLFUEvictor struct {
+	window, probation, protected *list.List // of *tinyLFUNode, newest first
+	nodes                        map[string]*tinyLFUNode
+	bytes                        [3]int64
+	capacity                     int64
+	sketch                       *countMinSketch
+}
+
+type tinyLFUNode struct {
+	key  string
+	size int64
+	seg  tinyLFUSegment
+	elem *list.Element
+}
+
+func newTinyLFUEvictor(capacity int64) *tinyLFUEvictor {
+	return &tinyLFUEvictor{
+		capacity:  capacity,
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		nodes:     make(map[string]*tinyLFUNode),
+		sketch:    newCountMinSketch(1024),
+	}
+}
+
+func (e *tinyLFUEvictor) add(key string, size int64) {
+	if node, ok := e.nodes[key]; ok {
+		e.bytes[node.seg] += size - node.size
+		node.size = size
+		e.access(key)
+		return
+	}
+	e.sketch.increment(key)
+	node := &tinyLFUNode{key: key, size: size}
+	e.nodes[key] = node
+	e.push(node, segWindow)
+	e.sketch.ensureCapacity(len(e.nodes))
+}
+
+func (e *tinyLFUEvictor) access(key string) {
+	e.sketch.increment(key)
+	node, ok := e.nodes[key]
+	if !ok {
+		return
+	}
+	switch node.seg {
+	case segWindow:
+		e.window.MoveToFront(node.elem)
+	case segProtected:
+		e.protected.MoveToFront(node.elem)
+	case segProbation:
+		e.unlink(node)
+		e.push(node, segProtected)
+		protectedTarget := (e.bytes[segProbation] + e.bytes[segProtected]) * tinyLFUProtectedPercent / 100
+		for e.bytes[segProtected] > protectedTarget && e.protected.Len() > 1 {
+			demoted := e.protected.Back().Value.(*tinyLFUNode)
+			e.unlink(demoted)
+			e.push(demoted, segProbation)
+		}
+	}
+}
+
+func (e *tinyLFUEvictor) remove(key string) {
+	if node, ok := e.nodes[key]; ok {
+		e.unlink(node)
+		delete(e.nodes, key)
+	}
+}
+
+func (e *tinyLFUEvictor) victim() (string, bool) {
+	windowTarget := e.capacity * tinyLFUWindowPercent / 100
+	mainTarget := e.capacity - windowTarget
+	for {
+		mainVictim := e.probation.Back()
+		if mainVictim == nil {
+			mainVictim = e.protected.Back()
+		}
+
+		if e.window.Len() == 0 || (e.bytes[segWindow] <= windowTarget && mainVictim != nil) {
+			if mainVictim == nil {
+				return "", false
+			}
+			return e.evict(mainVictim.Value.(*tinyLFUNode)), true
+		}
+
+		// The window is over its share: its oldest key moves to the main
+		// area while there is room, and otherwise has to beat the main
+		// area's victim on estimated frequency to stay.
+		candidate := e.window.Back().Value.(*tinyLFUNode)
+		mainBytes := e.bytes[segProbation] + e.bytes[segProtected]
+		if mainVictim == nil || mainBytes+candidate.size <= mainTarget {
+			if e.window.Len() == 1 && mainVictim == nil {
+				return e.evict(candidate), true
+			}
+			e.unlink(candidate)
+			e.push(candidate, segProbation)
+			continue
+		}
+		incumbent := mainVictim.Value.(*tinyLFUNode)
+		if e.sketch.estimate(candidate.key) > e.sketch.estimate(incumbent.key) {
+			e.unlink(candidate)
+			e.push(candidate, segProbation)
+			return e.evict(incumbent), true
+		}
+		return e.evict(candidate), true
+	}
+}
+
+func (e *tinyLFUEvictor) evict(node *tinyLFUNode) string {
+	e.remove(node.key)
+	return node.key
+}
+
+func (e *tinyLFUEvictor) segment(seg tinyLFUSegment) *list.List {
+	switch seg {
+	case segProbation:
+		return e.probation
+	case segProtected:
+		return e.protected
+	default:
+		return e.window
+	}
+}
+
+func (e *tinyLFUEvictor) push(node *tinyLFUNode, seg tinyLFUSegment) {
+	node.seg = seg
+	node.elem = e.segment(seg).PushFront(node)
+	e.bytes[seg] += node.size
+}
+
+func (e *tinyLFUEvictor) unlink(node *tinyLFUNode) {
+	e.segment(node.seg).Remove(node.elem)
+	e.bytes[node.seg] -= node.size
+}
+
+// countMinSketch estimates access frequencies with four rows of saturating
+// 4-bit-range counters. After sampleSize increments every counter is halved
+// so that old popularity fades.
+type countMinSketch struct {
+	seed       maphash.Seed
+	rows       [4][]uint8
+	mask       uint32
+	additions  int
+	sampleSize int
+}
+
+const (
+	sketchMaxCount = 15
+	sketchMaxWidth = 1 << 20
+)
+
+func newCountMinSketch(width int) *countMinSketch {
+	s := &countMinSketch{seed: maphash.MakeSeed()}
+	s.resize(width)
+	return s
+}
+
+func (s *countMinSketch) resize(width int) {
+	w := 1
+	for w < width {
+		w <<= 1
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	s.mask = uint32(w - 1)
+	s.additions = 0
+	s.sampleSize = 10 * w
+}
+
+// ensureCapacity widens the sketch once the cache tracks more keys than it
+// has counters. Widening starts the counts over.
+func (s *countMinSketch) ensureCapacity(n int) {
+	if n > len(s.rows[0]) && len(s.rows[0]) < sketchMaxWidth {
+		s.resize(min(2*len(s.rows[0]), sketchMaxWidth))
+	}
+}
+
+func (s *countMinSketch) indexes(key string) [4]uint32 {
+	h := maphash.String(s.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)
+	var idx [4]uint32
+	for i := range idx {
+		idx[i] = (h1 + uint32(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < sketchMaxCount {
+			s.rows[i][j]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.age()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	est := uint8(sketchMaxCount)
+	for i, j := range s.indexes(key) {
+		est = min(est, s.rows[i][j])
+	}
+	return est
+}
+
+func (s *countMinSketch) age() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
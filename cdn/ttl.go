@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicStatuses are the status codes RFC 9111 §4.2.2 lets a cache assign
+// a heuristic freshness lifetime to (the "heuristically cacheable" codes).
+var heuristicStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusPartialContent:       true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// ttlPolicy decides how long a response stays fresh. Origin headers come
+// first; responses without them get an operator default or, failing that, a
+// heuristic lifetime derived from Last-Modified. A nil policy only honours
+// explicit origin lifetimes and keeps nothing for revalidation.
+type ttlPolicy struct {
+	// heuristicPercent is the share of the time since Last-Modified used as
+	// the heuristic lifetime; 0 disables heuristics.
+	heuristicPercent int64
+	heuristicMax     time.Duration
+	rules            []ttlRule
+	// validationWindow is how long stale responses that must be revalidated
+	// (no-cache, must-revalidate, max-age=0) are kept for their validators.
+	validationWindow time.Duration
+}
+
+// ttlRule applies to responses matching its status codes and content types;
+// an empty list matches everything. def is used when the origin sent no
+// lifetime, min and max clamp whatever lifetime results. Zero means unset.
+type ttlRule struct {
+	statuses     []string // "200", or a class like "4xx"
+	contentTypes []string // "text/html", or a prefix like "image/*"
+	def          time.Duration
+	min          time.Duration
+	max          time.Duration
+}
+
+// freshness is what a ttlPolicy makes of a response.
+type freshness struct {
+	// store reports whether the response may be cached at all.
+	store bool
+	// ttl is how long it stays fresh; 0 means it is stored stale and
+	// revalidated on every use.
+	ttl time.Duration
+	// mustRevalidate forbids serving the response stale, even as an error
+	// fallback (no-cache, must-revalidate, proxy-revalidate).
+	mustRevalidate bool
+	// validationWindow is how long a stale copy that has to be revalidated
+	// is kept around for its validators.
+	validationWindow time.Duration
+}
+
+// decide works out whether and how long a response with the given status and
+// header may be cached. initialAge is how old the response already was when
+// it arrived, see correctedInitialAge.
+func (p *ttlPolicy) decide(status int, h http.Header, initialAge time.Duration) freshness {
+	flags, _ := parseCacheControl(h.Values("Cache-Control"))
+	// private responses are for the user's own cache only, whatever the
+	// rules or heuristics would make of them.
+	if flags["no-store"] || flags["private"] {
+		return freshness{}
+	}
+
+	lifetime, explicit := explicitFreshness(h)
+	if flags["no-cache"] {
+		lifetime, explicit = 0, true
+	}
+	if p != nil {
+		rule := p.match(status, h.Get("Content-Type"))
+		if !explicit {
+			if rule != nil && rule.def > 0 {
+				lifetime = rule.def
+			} else if heuristicStatuses[status] || flags["public"] {
+				lifetime = p.heuristic(h)
+			}
+		}
+		// A zero lifetime from the origin is a deliberate "revalidate every
+		// time", not an unreasonable value, so clamps leave it alone.
+		if rule != nil && lifetime > 0 {
+			if rule.min > 0 {
+				lifetime = max(lifetime, rule.min)
+			}
+			if rule.max > 0 {
+				lifetime = min(lifetime, rule.max)
+			}
+		}
+	}
+
+	f := freshness{
+		ttl:            max(lifetime-initialAge, 0),
+		mustRevalidate: flags["no-cache"] || flags["must-revalidate"] || flags["proxy-revalidate"],
+	}
+	// Responses that need revalidation are only worth keeping once stale if
+	// there is something to revalidate them with.
+	needsValidation := (explicit && lifetime <= 0) || f.mustRevalidate
+	hasValidator := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	if needsValidation && hasValidator && p != nil {
+		f.validationWindow = p.validationWindow
+	}
+	f.store = f.ttl > 0 || f.validationWindow > 0
+	return f
+}
+
+// apply sets the entry's lifetime and revalidation requirements from f.
+func (f freshness) apply(entry *CacheEntry, now time.Time) {
+	entry.expiresAt = now.Add(f.ttl)
+	entry.mustRevalidate = f.mustRevalidate
+	entry.validationWindow = f.validationWindow
+}
+
+// explicitFreshness returns the freshness lifetime the origin set through
+// s-maxage, max-age or Expires. explicit is false when it set none.
+func explicitFreshness(h http.Header) (lifetime time.Duration, explicit bool) {
+	_, maxAges := parseCacheControl(h.Values("Cache-Control"))
+	if v, ok := maxAges["s-maxage"]; ok {
+		return time.Duration(v) * time.Second, true
+	}
+	if v, ok := maxAges["max-age"]; ok {
+		return time.Duration(v) * time.Second, true
+	}
+	expires := h.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	// An invalid Expires means already expired (RFC 9111 §5.3).
+	expTime, err := http.ParseTime(expires)
+	if err != nil {
+		return 0, true
+	}
+	return expTime.Sub(responseDate(h)).Truncate(time.Second), true
+}
+
+// heuristic is the RFC 9111 §4.2.2 lifetime: a fraction of the time since
+// Last-Modified, capped at heuristicMax.
+func (p *ttlPolicy) heuristic(h http.Header) time.Duration {
+	if p.heuristicPercent <= 0 {
+		return 0
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return 0
+	}
+	age := responseDate(h).Sub(lm)
+	if age <= 0 {
+		return 0
+	}
+	lifetime := (age / 100 * time.Duration(p.heuristicPercent)).Truncate(time.Second)
+	if p.heuristicMax > 0 {
+		lifetime = min(lifetime, p.heuristicMax)
+	}
+	return lifetime
+}
+
+// correctedInitialAge is the age of a response when it was received, per RFC
+// 9111 §4.2.3: the larger of what the clocks imply (apparent age) and what
+// upstream caches reported in Age plus the time the request took.
+func correctedInitialAge(h http.Header, requestTime, responseTime time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		apparentAge = max(responseTime.Sub(date), 0)
+	}
+	ageValue := time.Duration(parseAgeHeader(h.Get("Age"))) * time.Second
+	correctedAgeValue := ageValue + responseTime.Sub(requestTime)
+	return max(apparentAge, correctedAgeValue)
+}
+
+// responseDate is the origin's Date header, or now if it is missing.
+func responseDate(h http.Header) time.Time {
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		return date
+	}
+	return time.Now()
+}
+
+// match returns the first rule that applies to the response, or nil.
+func (p *ttlPolicy) match(status int, contentType string) *ttlRule {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for i := range p.rules {
+		if p.rules[i].matches(status, mediaType) {
+			return &p.rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *ttlRule) matches(status int, mediaType string) bool {
+	if len(r.statuses) > 0 {
+		code := strconv.Itoa(status)
+		found := false
+		for _, s := range r.statuses {
+			if s == code || (strings.HasSuffix(s, "xx") && s[0] == code[0]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.contentTypes) == 0 {
+		return true
+	}
+	for _, ct := range r.contentTypes {
+		if prefix, ok := strings.CutSuffix(ct, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if ct == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTTLRules reads EDGE_TTL_RULES: rules separated by ";", each a list of
+// space-separated key=value settings, for example
+//
+//	status=200,301 type=text/html default=5m max=1h; status=404 default=30s
+//
+// Durations use Go syntax. Rules are tried in order and the first match wins.
+func parseTTLRules(raw string) ([]ttlRule, error) {
+	var rules []ttlRule
+	for _, spec := range strings.Split(raw, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		var rule ttlRule
+		for _, field := range fields {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok || value == "" {
+				return nil, fmt.Errorf("ttl rule %q: expected key=value, got %q", spec, field)
+			}
+			var err error
+			switch strings.ToLower(name) {
+			case "status":
+				for _, s := range splitCSV(value) {
+					s = strings.ToLower(s)
+					if !validStatusPattern(s) {
+						return nil, fmt.Errorf("ttl rule %q: invalid status %q", spec, s)
+					}
+					rule.statuses = append(rule.statuses, s)
+				}
+			case "type":
+				for _, ct := range splitCSV(value) {
+					rule.contentTypes = append(rule.contentTypes, strings.ToLower(ct))
+				}
+			case "default":
+				rule.def, err = time.ParseDuration(value)
+			case "min":
+				rule.min, err = time.ParseDuration(value)
+			case "max":
+				rule.max, err = time.ParseDuration(value)
+			default:
+				return nil, fmt.Errorf("ttl rule %q: unknown setting %q", spec, name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("ttl rule %q: %v", spec, err)
+			}
+		}
+		if rule.min > 0 && rule.max > 0 && rule.min > rule.max {
+			return nil, fmt.Errorf("ttl rule %q: min is greater than max", spec)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func validStatusPattern(s string) bool {
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if s[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// varyNormalizer rewrites request headers that responses commonly Vary on
+// down to a small set of values before the cache key is built. The
+// rewritten header is also what origin sees, so the stored variant always
+// matches the key it is stored under.
+type varyNormalizer struct {
+	// encodings are the content codings worth keeping apart, in order of
+	// preference. Accept-Encoding becomes the best of them the client
+	// takes, or "identity".
+	encodings []string
+	// languages are the languages the site is offered in, the first being
+	// the default. Accept-Language becomes the best match among them.
+	languages []string
+}
+
+// newVaryNormalizer builds a normalizer from the configured lists; "none"
+// turns one off. It returns nil when both are off.
+func newVaryNormalizer(encodings, languages []string) *varyNormalizer {
+	if len(encodings) == 1 && strings.EqualFold(encodings[0], "none") {
+		encodings = nil
+	}
+	if len(encodings) == 0 && len(languages) == 0 {
+		return nil
+	}
+	for i, enc := range encodings {
+		encodings[i] = strings.ToLower(enc)
+	}
+	return &varyNormalizer{encodings: encodings, languages: languages}
+}
+
+// normalizeRequest rewrites h in place.
+func (n *varyNormalizer) normalizeRequest(h http.Header) {
+	if n == nil {
+		return
+	}
+	if len(n.encodings) > 0 {
+		if v := h.Values("Accept-Encoding"); len(v) > 0 {
+			h.Set("Accept-Encoding", bestEncoding(strings.Join(v, ","), n.encodings))
+		}
+	}
+	if len(n.languages) > 0 {
+		h.Set("Accept-Language", bestLanguage(strings.Join(h.Values("Accept-Language"), ","), n.languages))
+	}
+}
+
+type qValue struct {
+	value string
+	q     float64
+}
+
+// parseQList parses a comma-separated list of values with optional q
+// weights, such as Accept-Encoding, sorted by descending weight. Values are
+// lowercased; ties keep the client's order.
+func parseQList(raw string) []qValue {
+	var out []qValue
+	for _, part := range strings.Split(raw, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			name, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+			if ok && strings.EqualFold(name, "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		out = append(out, qValue{value: value, q: q})
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].q > out[j].q })
+	return out
+}
+
+// bestEncoding picks the supported coding with the highest client weight,
+// breaking ties by the order of supported.
+func bestEncoding(acceptEncoding string, supported []string) string {
+	weights := make(map[string]float64)
+	for _, item := range parseQList(acceptEncoding) {
+		if _, seen := weights[item.value]; !seen {
+			weights[item.value] = item.q
+		}
+	}
+	best, bestQ := "identity", 0.0
+	for _, enc := range supported {
+		q, ok := weights[enc]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = enc, q
+		}
+	}
+	return best
+}
+
+// bestLanguage returns the first supported language matching the client's
+// preferences, where a range matches its own tag, its subtags and its
+// parent ("fr" and "fr-ca" match each other). Without a match it returns the
+// default, supported[0].
+func bestLanguage(acceptLanguage string, supported []string) string {
+	for _, item := range parseQList(acceptLanguage) {
+		if item.q <= 0 {
+			continue
+		}
+		if item.value == "*" {
+			return supported[0]
+		}
+		for _, lang := range supported {
+			if strings.EqualFold(lang, item.value) {
+				return lang
+			}
+		}
+		for _, lang := range supported {
+			l := strings.ToLower(lang)
+			if strings.HasPrefix(l, item.value+"-") || strings.HasPrefix(item.value, l+"-") {
+				return lang
+			}
+		}
+	}
+	return supported[0]
+}